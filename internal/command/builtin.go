@@ -0,0 +1,120 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/leogsouza/api-suchat/internal/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const shrug = `¯\\\_(ツ)\_/¯`
+
+func init() {
+	Register(Command{Name: "help", Help: "lists the commands", Run: help})
+	Register(Command{Name: "me", Usage: "<action>", Help: "posts an action", Run: me})
+	Register(Command{Name: "shrug", Usage: "[message]", Help: "posts a shrug", Run: shrugCmd})
+	Register(Command{Name: "topic", Usage: "[topic]", Help: "shows or changes the room topic", Run: topic})
+	Register(Command{Name: "invite", Usage: "@username", Help: "adds someone to the room", Run: invite})
+	Register(Command{Name: "mute", Usage: "[duration|off]", Help: "mutes the room notifications", Run: mute})
+}
+
+func help(c *Call) (Result, error) {
+	var b strings.Builder
+	for _, cmd := range c.registry.Commands() {
+		fmt.Fprintf(&b, "/%s", cmd.Name)
+		if cmd.Usage != "" {
+			fmt.Fprintf(&b, " %s", cmd.Usage)
+		}
+		fmt.Fprintf(&b, " - %s\n", cmd.Help)
+	}
+
+	return Result{Reply: strings.TrimSpace(b.String())}, nil
+}
+
+func me(c *Call) (Result, error) {
+	if c.Args == "" {
+		return Result{}, c.UsageError()
+	}
+
+	return Result{Message: "_" + c.Args + "_"}, nil
+}
+
+func shrugCmd(c *Call) (Result, error) {
+	return Result{Message: strings.TrimSpace(c.Args + " " + shrug)}, nil
+}
+
+func topic(c *Call) (Result, error) {
+	if c.Room.IsZero() {
+		return Result{}, ErrRoomRequired
+	}
+
+	if c.Args == "" {
+		room, err := c.Service.GetRoom(c.Ctx, c.Room)
+		if err != nil {
+			return Result{}, err
+		}
+		if room.Topic == "" {
+			return Result{Reply: "this room has no topic"}, nil
+		}
+		return Result{Reply: "topic: " + room.Topic}, nil
+	}
+
+	// the room announces the change with a system message
+	if _, err := c.Service.UpdateRoom(c.Ctx, c.Room, service.RoomSettings{Topic: &c.Args}); err != nil {
+		return Result{}, err
+	}
+
+	return Result{}, nil
+}
+
+func invite(c *Call) (Result, error) {
+	if c.Room.IsZero() {
+		return Result{}, ErrRoomRequired
+	}
+	if c.Args == "" || strings.ContainsAny(c.Args, " \t\n") {
+		return Result{}, c.UsageError()
+	}
+
+	u, err := c.Service.GetUserByUsername(c.Args)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := c.Service.AddRoomMember(c.Ctx, c.Room, u.ID); err != nil {
+		return Result{}, err
+	}
+
+	return Result{Reply: "added @" + u.Username + " to the room", Joined: []primitive.ObjectID{u.ID}}, nil
+}
+
+func mute(c *Call) (Result, error) {
+	if c.Room.IsZero() {
+		return Result{}, ErrRoomRequired
+	}
+
+	switch c.Args {
+	case "":
+		if _, err := c.Service.MuteRoom(c.Ctx, c.Room, nil); err != nil {
+			return Result{}, err
+		}
+		return Result{Reply: "room muted, /mute off to unmute"}, nil
+
+	case "off":
+		if _, err := c.Service.UnmuteRoom(c.Ctx, c.Room); err != nil {
+			return Result{}, err
+		}
+		return Result{Reply: "room unmuted"}, nil
+	}
+
+	d, err := time.ParseDuration(c.Args)
+	if err != nil || d <= 0 {
+		return Result{}, c.UsageError()
+	}
+	until := time.Now().Add(d)
+	if _, err := c.Service.MuteRoom(c.Ctx, c.Room, &until); err != nil {
+		return Result{}, err
+	}
+
+	return Result{Reply: "room muted for " + d.String()}, nil
+}
@@ -0,0 +1,153 @@
+// Package command runs the slash commands typed in chat messages, such as
+// "/topic Release day". Commands are kept in a Registry; the built-in ones
+// are registered in Default, where other packages can add their own.
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/leogsouza/api-suchat/internal/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrUnknownCommand used when no command is registered with the name.
+	ErrUnknownCommand = errors.New("unknown command, try /help")
+	// ErrRoomRequired used when a command that acts on a room is run in the lobby.
+	ErrRoomRequired = errors.New("this command only works in rooms")
+)
+
+var (
+	commandLine = regexp.MustCompile(`^/([a-z][a-z0-9_-]{0,31})(?:\s+([\s\S]*))?$`)
+	validName   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+)
+
+// Call is a command being run.
+type Call struct {
+	// Ctx is authenticated as the user that typed the command.
+	Ctx      context.Context
+	Service  *service.Service
+	User     primitive.ObjectID
+	Room     primitive.ObjectID
+	ParentID *primitive.ObjectID
+	Name     string
+	// Args is what follows the command name, trimmed.
+	Args string
+
+	usage    string
+	registry *Registry
+}
+
+// UsageError tells the caller how the command is used.
+func (c *Call) UsageError() error {
+	return fmt.Errorf("usage: /%s %s", c.Name, c.usage)
+}
+
+// Result is what a command answers. Reply is shown only to the caller,
+// Message is posted to the room as a normal message of the caller. Joined
+// lists the users the command added to the room.
+type Result struct {
+	Reply   string
+	Message string
+	Joined  []primitive.ObjectID
+}
+
+// Func runs a command.
+type Func func(c *Call) (Result, error)
+
+// Command is a named slash command.
+type Command struct {
+	Name string
+	// Usage describes the arguments, Help what the command does.
+	Usage string
+	Help  string
+	Run   Func
+}
+
+// Registry holds commands by name. It is safe for concurrent use.
+type Registry struct {
+	mu       sync.RWMutex
+	commands map[string]Command
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{commands: make(map[string]Command)}
+}
+
+// Default is the registry chat messages are run against. It holds the
+// built-in commands.
+var Default = NewRegistry()
+
+// Register adds a command to Default.
+func Register(cmd Command) {
+	Default.Register(cmd)
+}
+
+// Register adds a command. It panics if the name is invalid or already
+// taken, since that is a programming error.
+func (r *Registry) Register(cmd Command) {
+	if !validName.MatchString(cmd.Name) {
+		panic("command: invalid name " + cmd.Name)
+	}
+	if cmd.Run == nil {
+		panic("command: nil func for " + cmd.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.commands[cmd.Name]; ok {
+		panic("command: " + cmd.Name + " registered twice")
+	}
+	r.commands[cmd.Name] = cmd
+}
+
+// Lookup finds a command by name.
+func (r *Registry) Lookup(name string) (Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.commands[name]
+
+	return cmd, ok
+}
+
+// Commands lists the registered commands by name.
+func (r *Registry) Commands() []Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmds := make([]Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+
+	return cmds
+}
+
+// Run runs the command the call names.
+func (r *Registry) Run(c *Call) (Result, error) {
+	cmd, ok := r.Lookup(c.Name)
+	if !ok {
+		return Result{}, ErrUnknownCommand
+	}
+	c.usage, c.registry = cmd.Usage, r
+
+	return cmd.Run(c)
+}
+
+// Parse splits a message into a command name and its arguments. Messages
+// that don't start with a single "/" and a name aren't commands.
+func Parse(message string) (name, args string, ok bool) {
+	m := commandLine.FindStringSubmatch(strings.TrimSpace(message))
+	if m == nil {
+		return "", "", false
+	}
+
+	return m[1], strings.TrimSpace(m[2]), true
+}
@@ -0,0 +1,97 @@
+package command
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		message string
+		name    string
+		args    string
+		ok      bool
+	}{
+		{message: "/help", name: "help", ok: true},
+		{message: "/topic Release day", name: "topic", args: "Release day", ok: true},
+		{message: "  /me  waves  ", name: "me", args: "waves", ok: true},
+		{message: "/me waves\nand leaves", name: "me", args: "waves\nand leaves", ok: true},
+		{message: "/shrug\tok", name: "shrug", args: "ok", ok: true},
+		{message: "/read-only_2 x", name: "read-only_2", args: "x", ok: true},
+		{message: "hello /help"},
+		{message: "/"},
+		{message: "//help"},
+		{message: "/Help"},
+		{message: "/2fa"},
+		{message: "/help!"},
+		{message: "/path/to/file"},
+		{message: "/" + "abcdefghijklmnopqrstuvwxyzabcdefg"},
+		{message: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			name, args, ok := Parse(tt.message)
+			if name != tt.name || args != tt.args || ok != tt.ok {
+				t.Errorf("Parse(%q) = %q, %q, %v, want %q, %q, %v", tt.message, name, args, ok, tt.name, tt.args, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.Register(Command{Name: "echo", Usage: "<text>", Run: func(c *Call) (Result, error) {
+		if c.Args == "" {
+			return Result{}, c.UsageError()
+		}
+		return Result{Reply: c.Args}, nil
+	}})
+
+	tests := []struct {
+		name    string
+		call    Call
+		reply   string
+		wantErr string
+	}{
+		{name: "runs", call: Call{Name: "echo", Args: "hi"}, reply: "hi"},
+		{name: "usage", call: Call{Name: "echo"}, wantErr: "usage: /echo <text>"},
+		{name: "unknown", call: Call{Name: "nope"}, wantErr: ErrUnknownCommand.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := r.Run(&tt.call)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("Run() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || res.Reply != tt.reply {
+				t.Errorf("Run() = %q, %v, want %q", res.Reply, err, tt.reply)
+			}
+		})
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	run := func(*Call) (Result, error) { return Result{}, nil }
+
+	tests := []struct {
+		name string
+		cmd  Command
+	}{
+		{"invalid name", Command{Name: "Bad Name", Run: run}},
+		{"nil func", Command{Name: "nil"}},
+		{"duplicate", Command{Name: "dup", Run: run}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			r.Register(Command{Name: "dup", Run: run})
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%q) didn't panic", tt.cmd.Name)
+				}
+			}()
+			r.Register(tt.cmd)
+		})
+	}
+}
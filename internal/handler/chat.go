@@ -1,26 +1,298 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/gookit/validate"
+	"github.com/leogsouza/api-suchat/internal/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 const maxUploadSize = 100 << 20 // 100 MB
-const uploadPath = "./uploads"
 const fileNameSize = 16
 
 func (h *handler) getChats(w http.ResponseWriter, r *http.Request) {
-	chats, err := h.GetChats()
+	var roomID primitive.ObjectID
+	if room := r.URL.Query().Get("room"); room != "" {
+		var err error
+		if roomID, err = primitive.ObjectIDFromHex(room); err != nil {
+			respondHTTPError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	chats, err := h.GetChats(r.Context(), roomID)
 	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, chats, http.StatusOK)
+}
+
+type createChatInput struct {
+	Room     string           `json:"room"`
+	ParentID string           `json:"parent_id"`
+	Type     string           `json:"type"`
+	Message  string           `json:"message"`
+	Payload  *service.Payload `json:"payload"`
+	TTL      int64            `json:"ttl"`
+	// ClientMsgID makes resending the same message safe.
+	ClientMsgID string `json:"client_msg_id"`
+}
+
+func (in createChatInput) chat(sender primitive.ObjectID) (service.Chat, error) {
+	chat := service.Chat{
+		ID:          primitive.NewObjectID(),
+		Sender:      sender,
+		Type:        in.Type,
+		Message:     in.Message,
+		Payload:     in.Payload,
+		TTL:         in.TTL,
+		ClientMsgID: in.ClientMsgID,
+	}
 
+	var err error
+	if in.Room != "" {
+		if chat.Room, err = primitive.ObjectIDFromHex(in.Room); err != nil {
+			return chat, err
+		}
+	}
+	if in.ParentID != "" {
+		parentID, err := primitive.ObjectIDFromHex(in.ParentID)
+		if err != nil {
+			return chat, err
+		}
+		chat.ParentID = &parentID
+	}
+
+	return chat, nil
+}
+
+type editChatInput struct {
+	Message string `json:"message" validate:"required"`
+}
+
+func (h *handler) createChat(w http.ResponseWriter, r *http.Request) {
+	var in createChatInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
 		respondHTTPError(w, err, http.StatusBadRequest)
+		return
 	}
 
-	respond(w, chats, http.StatusOK)
+	userID, err := h.AuthUserID(r.Context())
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	chat, err := in.chat(userID)
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	out, err := h.SaveChat(chat)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+	if out.ID != chat.ID {
+		// a resend, the original was returned
+		respond(w, out, http.StatusOK)
+		return
+	}
+	h.typing.stop(chat.Room, userID)
+
+	respond(w, out, http.StatusCreated)
+}
+
+func (h *handler) searchChats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page, _ := strconv.Atoi(q.Get("page"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+
+	query, err := service.ParseSearchQuery(q.Get("q"), page, limit)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	results, err := h.SearchChats(r.Context(), query)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, results, http.StatusOK)
+}
+
+func (h *handler) editChat(w http.ResponseWriter, r *http.Request) {
+	chatID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var in editChatInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	v := validate.Struct(in)
+	if !v.Validate() {
+		respond(w, v.Errors, http.StatusUnprocessableEntity)
+		return
+	}
+
+	out, err := h.EditChat(r.Context(), chatID, in.Message)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, out, http.StatusOK)
+}
+
+func (h *handler) getChatEdits(w http.ResponseWriter, r *http.Request) {
+	chatID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	edits, err := h.GetChatEdits(r.Context(), chatID)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, edits, http.StatusOK)
+}
+
+func (h *handler) deleteChat(w http.ResponseWriter, r *http.Request) {
+	chatID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	out, err := h.DeleteChat(r.Context(), chatID)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, out, http.StatusOK)
+}
+
+type reactionFunc func(context.Context, primitive.ObjectID, string) (service.ReactionUpdate, error)
+
+type voteFunc func(context.Context, primitive.ObjectID, int) (service.PollUpdate, error)
+
+func (h *handler) getSeenBy(w http.ResponseWriter, r *http.Request) {
+	chatID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	users, err := h.GetSeenBy(r.Context(), chatID)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, users, http.StatusOK)
+}
+
+func (h *handler) getThread(w http.ResponseWriter, r *http.Request) {
+	chatID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	replies, err := h.GetThread(r.Context(), chatID)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, replies, http.StatusOK)
+}
+
+func (h *handler) addReaction(w http.ResponseWriter, r *http.Request) {
+	h.setReaction(w, r, h.AddReaction)
+}
+
+func (h *handler) removeReaction(w http.ResponseWriter, r *http.Request) {
+	h.setReaction(w, r, h.RemoveReaction)
+}
+
+func (h *handler) setReaction(w http.ResponseWriter, r *http.Request, set reactionFunc) {
+	chatID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	emoji, err := url.PathUnescape(chi.URLParam(r, "emoji"))
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	update, err := set(r.Context(), chatID, emoji)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, update, http.StatusOK)
+}
+
+func (h *handler) vote(w http.ResponseWriter, r *http.Request) {
+	h.setVote(w, r, h.Vote)
+}
+
+func (h *handler) unvote(w http.ResponseWriter, r *http.Request) {
+	h.setVote(w, r, h.Unvote)
+}
+
+func (h *handler) setVote(w http.ResponseWriter, r *http.Request, set voteFunc) {
+	chatID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	option, err := strconv.Atoi(chi.URLParam(r, "option"))
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	update, err := set(r.Context(), chatID, option)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, update, http.StatusOK)
 }
 
 func (h *handler) upload(w http.ResponseWriter, r *http.Request) {
@@ -53,6 +325,7 @@ func (h *handler) upload(w http.ResponseWriter, r *http.Request) {
 	switch detectedFileType {
 	case "image/jpeg", "image/jpg":
 	case "image/gif", "image/png", "video/mp4":
+	case "audio/mpeg", "audio/wave", "application/pdf":
 		break
 	default:
 		respondHTTPError(w, fmt.Errorf("INVALID_FILE_TYPE: %v", err), http.StatusBadRequest)
@@ -61,12 +334,15 @@ func (h *handler) upload(w http.ResponseWriter, r *http.Request) {
 
 	fileName := uniqueToken(fileNameSize)
 	fileEndings, err := mime.ExtensionsByType(detectedFileType)
+	if err == nil && len(fileEndings) == 0 {
+		err = fmt.Errorf("no extension for %s", detectedFileType)
+	}
 	if err != nil {
 		respondHTTPError(w, fmt.Errorf("CANT_READ_FILE_TYPE: %v", err), http.StatusBadRequest)
 		return
 	}
-	createUploadFolder(uploadPath)
-	newPath := filepath.Join(uploadPath, fileName+fileEndings[0])
+	createUploadFolder(service.UploadPath)
+	newPath := filepath.Join(service.UploadPath, fileName+fileEndings[0])
 	fmt.Printf("FileType: %s, File: %s\n", detectedFileType, newPath)
 
 	newFile, err := os.Create(newPath)
@@ -81,6 +357,12 @@ func (h *handler) upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, err := h.SaveUpload(r.Context(), fileName+fileEndings[0], detectedFileType, int64(len(fileBytes))); err != nil {
+		os.Remove(newPath)
+		respondServiceError(w, err)
+		return
+	}
+
 	uploadSuccess := uploadSuccess{
 		true,
 		"files/" + fileName + fileEndings[0],
@@ -93,3 +375,74 @@ type uploadSuccess struct {
 	Success bool   `json:"success"`
 	URL     string `json:"url"`
 }
+
+type syncInput struct {
+	Rooms []struct {
+		Room string `json:"room"`
+		Seq  int64  `json:"seq"`
+		ID   string `json:"id"`
+	} `json:"rooms"`
+}
+
+type ackInput struct {
+	Room string `json:"room"`
+	Seq  int64  `json:"seq" validate:"required|min:1"`
+}
+
+func (h *handler) syncChats(w http.ResponseWriter, r *http.Request) {
+	var in syncInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	cursors := make([]service.SyncCursor, len(in.Rooms))
+	for i, room := range in.Rooms {
+		cursor, err := syncCursor(room.Room, room.Seq, room.ID)
+		if err != nil {
+			respondHTTPError(w, err, http.StatusBadRequest)
+			return
+		}
+		cursors[i] = cursor
+	}
+
+	outs, err := h.Sync(r.Context(), cursors)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, outs, http.StatusOK)
+}
+
+func (h *handler) ackChats(w http.ResponseWriter, r *http.Request) {
+	var in ackInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	v := validate.Struct(in)
+	if !v.Validate() {
+		respond(w, v.Errors, http.StatusUnprocessableEntity)
+		return
+	}
+
+	var roomID primitive.ObjectID
+	if in.Room != "" {
+		var err error
+		if roomID, err = primitive.ObjectIDFromHex(in.Room); err != nil {
+			respondHTTPError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.AckDelivery(r.Context(), roomID, in.Seq); err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
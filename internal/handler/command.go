@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+
+	gosocketio "github.com/ambelovsky/gosf-socketio"
+	"github.com/leogsouza/api-suchat/internal/command"
+	"github.com/leogsouza/api-suchat/internal/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// commandReply is emitted only to the socket that ran the command.
+type commandReply struct {
+	Command  string              `json:"command"`
+	Room     primitive.ObjectID  `json:"room,omitempty"`
+	ParentID *primitive.ObjectID `json:"parent_id,omitempty"`
+	Text     string              `json:"text"`
+	Error    bool                `json:"error,omitempty"`
+}
+
+// commandAck answers a command sent with a client message ID. Chat is the
+// message the command posted, if any.
+type commandAck struct {
+	Command string      `json:"command"`
+	Reply   string      `json:"reply,omitempty"`
+	Chat    interface{} `json:"chat,omitempty"`
+}
+
+// runCommand runs the slash command typed in place of the chat. Replies go
+// back to the caller's socket, messages are sent like any other chat.
+// Commands sent with a client message ID run once, resending them gets the
+// same ack.
+func (h *handler) runCommand(c *gosocketio.Channel, chat service.Chat, name, args string) string {
+	reply := commandReply{Command: name, Room: chat.Room, ParentID: chat.ParentID}
+
+	var run service.CommandRun
+	if chat.ClientMsgID != "" {
+		var done bool
+		var err error
+		if run, done, err = h.StartCommandRun(chat.Sender, chat.ClientMsgID, name); err != nil {
+			return ackError(err)
+		}
+		if done {
+			return h.commandAck(chat, name, run.Reply, run.Message)
+		}
+	}
+
+	res, err := h.commands.Run(&command.Call{
+		Ctx:      h.socketContext(c),
+		Service:  h.Service,
+		User:     chat.Sender,
+		Room:     chat.Room,
+		ParentID: chat.ParentID,
+		Name:     name,
+		Args:     args,
+	})
+	if err != nil {
+		if chat.ClientMsgID != "" {
+			if err := h.DropCommandRun(run); err != nil {
+				log.Printf("could not drop run of /%s: %v", name, err)
+			}
+		}
+		reply.Text, reply.Error = err.Error(), true
+		go c.Emit("command_reply", reply)
+		return ackError(err)
+	}
+
+	if res.Reply != "" {
+		reply.Text = res.Reply
+		go c.Emit("command_reply", reply)
+	}
+	for _, uid := range res.Joined {
+		h.joinRoomChannels(uid, chat.Room)
+	}
+	if chat.ClientMsgID != "" {
+		if err := h.FinishCommandRun(run, res.Reply, res.Message); err != nil {
+			log.Printf("could not record run of /%s: %v", name, err)
+		}
+	}
+
+	return h.commandAck(chat, name, res.Reply, res.Message)
+}
+
+// commandAck sends the message the command posts, if any, and answers with
+// the JSON ack when the chat has a client message ID. Sending the message
+// is safe to repeat, it has the client message ID of the command.
+func (h *handler) commandAck(chat service.Chat, name, reply, message string) string {
+	ack := commandAck{Command: name, Reply: reply}
+	if message != "" {
+		chat.Message = message
+		out, err := h.SaveChat(chat)
+		if err != nil {
+			return ackError(err)
+		}
+		h.typing.stop(chat.Room, chat.Sender)
+		ack.Chat = out
+	}
+	if chat.ClientMsgID == "" {
+		return "OK"
+	}
+
+	b, err := json.Marshal(ack)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gookit/validate"
+)
+
+type exportRoomInput struct {
+	Format string    `json:"format" validate:"required|in:jsonl,csv,html"`
+	From   time.Time `json:"from"`
+	// To defaults to now.
+	To time.Time `json:"to"`
+}
+
+func (h *handler) exportRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var in exportRoomInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	v := validate.Struct(in)
+	if !v.Validate() {
+		respond(w, v.Errors, http.StatusUnprocessableEntity)
+		return
+	}
+
+	job, err := h.ExportRoom(r.Context(), roomID, in.Format, in.From, in.To)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, job, http.StatusAccepted)
+}
+
+func (h *handler) getExport(w http.ResponseWriter, r *http.Request) {
+	id, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	job, err := h.GetExport(r.Context(), id)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, job, http.StatusOK)
+}
+
+func (h *handler) downloadExport(w http.ResponseWriter, r *http.Request) {
+	id, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	path, name, err := h.ExportFile(r.Context(), id)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	http.ServeFile(w, r, path)
+}
@@ -6,22 +6,30 @@ import (
 	"path/filepath"
 	"strings"
 
+	gosocketio "github.com/ambelovsky/gosf-socketio"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
 	"github.com/go-chi/render"
 
+	"github.com/leogsouza/api-suchat/internal/command"
 	"github.com/leogsouza/api-suchat/internal/logger"
 	"github.com/leogsouza/api-suchat/internal/service"
 )
 
 type handler struct {
 	*service.Service
+	io       *gosocketio.Server
+	sessions *sessions
+	typing   *typing
+	commands *command.Registry
 }
 
 func New(s *service.Service) http.Handler {
 
-	h := &handler{s}
+	h := &handler{Service: s, sessions: newSessions(), commands: command.Default}
+	h.typing = newTyping(h.broadcastTyping)
+	s.SetBroadcaster(h)
 
 	logrus := logger.New()
 
@@ -34,7 +42,7 @@ func New(s *service.Service) http.Handler {
 
 	cors := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
@@ -52,17 +60,81 @@ func New(s *service.Service) http.Handler {
 				r.Use(h.withAuth)
 				r.Get("/auth", h.authUser)
 				r.Get("/logout", h.logout)
+				r.Get("/me/notifications", h.getNotifications)
+				r.Get("/me/saved", h.getSavedChats)
 			})
 		})
 
 		r.Route("/chats", func(r chi.Router) {
+			r.Use(h.withAuth)
 			r.Get("/", h.getChats)
+			r.Post("/", h.createChat)
 			r.Post("/upload", h.upload)
+			r.Get("/search", h.searchChats)
+			r.Post("/sync", h.syncChats)
+			r.Post("/ack", h.ackChats)
+			r.Get("/scheduled", h.getScheduledChats)
+			r.Post("/scheduled", h.scheduleChat)
+			r.Patch("/scheduled/{id}", h.updateScheduledChat)
+			r.Delete("/scheduled/{id}", h.cancelScheduledChat)
+			r.Patch("/{id}", h.editChat)
+			r.Delete("/{id}", h.deleteChat)
+			r.Put("/{id}/reactions/{emoji}", h.addReaction)
+			r.Delete("/{id}/reactions/{emoji}", h.removeReaction)
+			r.Put("/{id}/votes/{option}", h.vote)
+			r.Delete("/{id}/votes/{option}", h.unvote)
+			r.Get("/{id}/edits", h.getChatEdits)
+			r.Get("/{id}/thread", h.getThread)
+			r.Get("/{id}/seen", h.getSeenBy)
+			r.Put("/{id}/saved", h.saveChat)
+			r.Delete("/{id}/saved", h.unsaveChat)
 
 		})
+
+		r.Route("/rooms", func(r chi.Router) {
+			r.Use(h.withAuth)
+			r.Get("/", h.getRooms)
+			r.Post("/", h.createRoom)
+			r.Route("/{id}", func(r chi.Router) {
+				r.Get("/", h.getRoom)
+				r.Patch("/", h.updateRoom)
+				r.Post("/join", h.joinRoom)
+				r.Post("/leave", h.leaveRoom)
+				r.Get("/members", h.getRoomMembers)
+				r.Post("/members", h.addRoomMember)
+				r.Put("/members/{user}/role", h.setRoomMemberRole)
+				r.Post("/owner", h.transferOwnership)
+				r.Post("/invites", h.createInvite)
+				r.Post("/read", h.markRead)
+				r.Get("/pins", h.getPins)
+				r.Put("/pins/{chat}", h.pinChat)
+				r.Delete("/pins/{chat}", h.unpinChat)
+				r.Get("/retention", h.getRetention)
+				r.Put("/retention", h.updateRetention)
+				r.Post("/purge", h.purgeRoom)
+				r.Post("/exports", h.exportRoom)
+			})
+		})
+
+		r.With(h.withAuth).Get("/conversations", h.getConversations)
+
+		r.Route("/exports", func(r chi.Router) {
+			r.Use(h.withAuth)
+			r.Get("/{id}", h.getExport)
+			r.Get("/{id}/download", h.downloadExport)
+		})
+		r.Route("/imports", func(r chi.Router) {
+			r.Use(h.withAuth)
+			r.Post("/slack", h.importSlack)
+			r.Post("/placeholders/{id}/claim", h.claimPlaceholder)
+		})
+		r.Route("/invites", func(r chi.Router) {
+			r.Use(h.withAuth)
+			r.Post("/{token}", h.acceptInvite)
+		})
 	})
 	workDir, _ := os.Getwd()
-	filesDir := http.Dir(filepath.Join(workDir, "uploads"))
+	filesDir := http.Dir(filepath.Join(workDir, service.UploadPath))
 	FileServer(r, "/files", filesDir)
 	h.socketHandler()
 
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const maxImportSize = 1 << 30 // 1 GB
+
+func (h *handler) importSlack(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	defer r.Body.Close()
+
+	// big archives are spooled to disk instead of memory
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		respondHTTPError(w, fmt.Errorf("FILE_TOO_BIG: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		respondHTTPError(w, fmt.Errorf("INVALID_FILE: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	result, err := h.ImportSlack(r.Context(), file, header.Size)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, result, http.StatusOK)
+}
+
+// claimPlaceholder gives an imported placeholder to the user in the body.
+func (h *handler) claimPlaceholder(w http.ResponseWriter, r *http.Request) {
+	placeholderID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := decodeRoomUserInput(r)
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.ClaimPlaceholder(r.Context(), placeholderID, userID); err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,475 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/gookit/validate"
+	"github.com/leogsouza/api-suchat/internal/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type createRoomInput struct {
+	Name              string `json:"name" validate:"required"`
+	Private           bool   `json:"private"`
+	HistoryVisibility string `json:"history_visibility" validate:"in:joined,all"`
+}
+
+func (h *handler) createRoom(w http.ResponseWriter, r *http.Request) {
+	var in createRoomInput
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	v := validate.Struct(in)
+	if !v.Validate() {
+		respond(w, v.Errors, http.StatusUnprocessableEntity)
+		return
+	}
+
+	room, err := h.CreateRoom(r.Context(), in.Name, in.Private, in.HistoryVisibility)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	if uid, err := h.AuthUserID(r.Context()); err == nil {
+		h.joinRoomChannels(uid, room.ID)
+	}
+
+	respond(w, room, http.StatusCreated)
+}
+
+func (h *handler) getRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := h.GetRooms(r.Context())
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, rooms, http.StatusOK)
+}
+
+func (h *handler) getRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	room, err := h.GetRoom(r.Context(), roomID)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, room, http.StatusOK)
+}
+
+type updateRoomInput struct {
+	Name              *string `json:"name"`
+	Topic             *string `json:"topic"`
+	HistoryVisibility *string `json:"history_visibility"`
+	PinPermission     *string `json:"pin_permission"`
+	MessageTTL        *int64  `json:"message_ttl"`
+}
+
+func (h *handler) updateRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var in updateRoomInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	room, err := h.UpdateRoom(r.Context(), roomID, service.RoomSettings{
+		Name:              in.Name,
+		Topic:             in.Topic,
+		HistoryVisibility: in.HistoryVisibility,
+		PinPermission:     in.PinPermission,
+		MessageTTL:        in.MessageTTL,
+	})
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, room, http.StatusOK)
+}
+
+func (h *handler) joinRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	room, err := h.JoinRoom(r.Context(), roomID)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	if uid, err := h.AuthUserID(r.Context()); err == nil {
+		h.joinRoomChannels(uid, room.ID)
+	}
+
+	respond(w, room, http.StatusOK)
+}
+
+func (h *handler) leaveRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.LeaveRoom(r.Context(), roomID); err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	if uid, err := h.AuthUserID(r.Context()); err == nil {
+		h.leaveRoomChannels(uid, roomID)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) getRoomMembers(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	members, err := h.GetRoomMembers(r.Context(), roomID)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, members, http.StatusOK)
+}
+
+type roomUserInput struct {
+	UserID string `json:"user_id"`
+}
+
+func decodeRoomUserInput(r *http.Request) (primitive.ObjectID, error) {
+	var in roomUserInput
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return primitive.ObjectIDFromHex(in.UserID)
+}
+
+func (h *handler) addRoomMember(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := decodeRoomUserInput(r)
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.AddRoomMember(r.Context(), roomID, userID); err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	h.joinRoomChannels(userID, roomID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type markReadInput struct {
+	ChatID string `json:"chat_id"`
+}
+
+func (h *handler) markRead(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var in markReadInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	chatID, err := primitive.ObjectIDFromHex(in.ChatID)
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	state, err := h.MarkRead(r.Context(), roomID, chatID)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, state, http.StatusOK)
+}
+
+func (h *handler) getConversations(w http.ResponseWriter, r *http.Request) {
+	convs, err := h.GetConversations(r.Context())
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, convs, http.StatusOK)
+}
+
+func (h *handler) getPins(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	pins, err := h.GetPins(r.Context(), roomID)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, pins, http.StatusOK)
+}
+
+func (h *handler) pinChat(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	chatID, err := objectIDParam(r, "chat")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	pin, err := h.PinChat(r.Context(), roomID, chatID)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, pin, http.StatusOK)
+}
+
+func (h *handler) unpinChat(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	chatID, err := objectIDParam(r, "chat")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.UnpinChat(r.Context(), roomID, chatID); err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type roomRoleInput struct {
+	Role string `json:"role" validate:"required|in:moderator,member"`
+}
+
+func (h *handler) setRoomMemberRole(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := objectIDParam(r, "user")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var in roomRoleInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	v := validate.Struct(in)
+	if !v.Validate() {
+		respond(w, v.Errors, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := h.SetRoomMemberRole(r.Context(), roomID, userID, in.Role); err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) transferOwnership(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := decodeRoomUserInput(r)
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.TransferOwnership(r.Context(), roomID, userID); err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type createInviteInput struct {
+	// ExpiresIn is the invite lifetime in seconds, zero never expires.
+	ExpiresIn int `json:"expires_in" validate:"min:0"`
+	// MaxUses is how many times the invite can be used, zero is unlimited.
+	MaxUses int `json:"max_uses" validate:"min:0"`
+}
+
+func (h *handler) createInvite(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var in createInviteInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	v := validate.Struct(in)
+	if !v.Validate() {
+		respond(w, v.Errors, http.StatusUnprocessableEntity)
+		return
+	}
+
+	invite, err := h.CreateInvite(r.Context(), roomID, time.Duration(in.ExpiresIn)*time.Second, in.MaxUses)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, invite, http.StatusCreated)
+}
+
+func (h *handler) acceptInvite(w http.ResponseWriter, r *http.Request) {
+	room, err := h.AcceptInvite(r.Context(), chi.URLParam(r, "token"))
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	if uid, err := h.AuthUserID(r.Context()); err == nil {
+		h.joinRoomChannels(uid, room.ID)
+	}
+
+	respond(w, room, http.StatusOK)
+}
+
+func (h *handler) getRetention(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	retention, err := h.GetRetention(r.Context(), roomID)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, retention, http.StatusOK)
+}
+
+type updateRetentionInput struct {
+	Days   *int    `json:"days"`
+	Action *string `json:"action"`
+}
+
+func (h *handler) updateRetention(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var in updateRetentionInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	retention, err := h.UpdateRetention(r.Context(), roomID, service.RetentionSettings{Days: in.Days, Action: in.Action})
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, retention, http.StatusOK)
+}
+
+func (h *handler) purgeRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	run, err := h.PurgeRoom(r.Context(), roomID, dryRun)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, run, http.StatusOK)
+}
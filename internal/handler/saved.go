@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+type saveChatInput struct {
+	Note     string     `json:"note"`
+	RemindAt *time.Time `json:"remind_at"`
+}
+
+func (h *handler) saveChat(w http.ResponseWriter, r *http.Request) {
+	chatID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// the body is optional, a bare PUT just bookmarks the message
+	var in saveChatInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil && err != io.EOF {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	saved, err := h.SaveChatForLater(r.Context(), chatID, in.Note, in.RemindAt)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, saved, http.StatusOK)
+}
+
+func (h *handler) unsaveChat(w http.ResponseWriter, r *http.Request) {
+	chatID, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.UnsaveChat(r.Context(), chatID); err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) getSavedChats(w http.ResponseWriter, r *http.Request) {
+	saved, err := h.GetSavedChats(r.Context())
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, saved, http.StatusOK)
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/leogsouza/api-suchat/internal/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type scheduleChatInput struct {
+	createChatInput
+	SendAt time.Time `json:"send_at"`
+}
+
+type updateScheduledChatInput struct {
+	Message *string          `json:"message"`
+	Payload *service.Payload `json:"payload"`
+	SendAt  *time.Time       `json:"send_at"`
+}
+
+func (h *handler) scheduleChat(w http.ResponseWriter, r *http.Request) {
+	var in scheduleChatInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// the sender is set by the service
+	chat, err := in.chat(primitive.NilObjectID)
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	scheduled, err := h.ScheduleChat(r.Context(), chat, in.SendAt)
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, scheduled, http.StatusCreated)
+}
+
+func (h *handler) getScheduledChats(w http.ResponseWriter, r *http.Request) {
+	scheduled, err := h.GetScheduledChats(r.Context())
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, scheduled, http.StatusOK)
+}
+
+func (h *handler) updateScheduledChat(w http.ResponseWriter, r *http.Request) {
+	id, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var in updateScheduledChatInput
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	scheduled, err := h.UpdateScheduledChat(r.Context(), id, service.ScheduledChatUpdate{
+		Message: in.Message,
+		Payload: in.Payload,
+		SendAt:  in.SendAt,
+	})
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, scheduled, http.StatusOK)
+}
+
+func (h *handler) cancelScheduledChat(w http.ResponseWriter, r *http.Request) {
+	id, err := objectIDParam(r, "id")
+	if err != nil {
+		respondHTTPError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.CancelScheduledChat(r.Context(), id); err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	gosocketio "github.com/ambelovsky/gosf-socketio"
+	"github.com/leogsouza/api-suchat/internal/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const lobbyChannel = "chat"
+
+type session struct {
+	UserID primitive.ObjectID
+	Email  string
+}
+
+// sessions keeps track of the authenticated socket connections so REST
+// handlers can reach the sockets of a given user.
+type sessions struct {
+	sync.RWMutex
+	byChannel map[string]session
+	byUser    map[primitive.ObjectID]map[string]*gosocketio.Channel
+	// threads maps the threads each socket follows to their rooms, so
+	// leaving a room leaves its threads too.
+	threads map[string]map[primitive.ObjectID]primitive.ObjectID
+}
+
+func newSessions() *sessions {
+	return &sessions{
+		byChannel: make(map[string]session),
+		byUser:    make(map[primitive.ObjectID]map[string]*gosocketio.Channel),
+		threads:   make(map[string]map[primitive.ObjectID]primitive.ObjectID),
+	}
+}
+
+func (s *sessions) add(c *gosocketio.Channel, sess session) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.byChannel[c.Id()] = sess
+	if _, ok := s.byUser[sess.UserID]; !ok {
+		s.byUser[sess.UserID] = make(map[string]*gosocketio.Channel)
+	}
+	s.byUser[sess.UserID][c.Id()] = c
+}
+
+func (s *sessions) remove(c *gosocketio.Channel) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.threads, c.Id())
+	sess, ok := s.byChannel[c.Id()]
+	if !ok {
+		return
+	}
+	delete(s.byChannel, c.Id())
+	delete(s.byUser[sess.UserID], c.Id())
+	if len(s.byUser[sess.UserID]) == 0 {
+		delete(s.byUser, sess.UserID)
+	}
+}
+
+func (s *sessions) get(c *gosocketio.Channel) (session, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	sess, ok := s.byChannel[c.Id()]
+	return sess, ok
+}
+
+func (s *sessions) channels(userID primitive.ObjectID) []*gosocketio.Channel {
+	s.RLock()
+	defer s.RUnlock()
+
+	var cs []*gosocketio.Channel
+	for _, c := range s.byUser[userID] {
+		cs = append(cs, c)
+	}
+
+	return cs
+}
+
+func (s *sessions) followThread(c *gosocketio.Channel, parentID, roomID primitive.ObjectID) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.threads[c.Id()]; !ok {
+		s.threads[c.Id()] = make(map[primitive.ObjectID]primitive.ObjectID)
+	}
+	s.threads[c.Id()][parentID] = roomID
+}
+
+func (s *sessions) unfollowThread(c *gosocketio.Channel, parentID primitive.ObjectID) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.threads[c.Id()], parentID)
+}
+
+// unfollowRoomThreads forgets the threads of the room the socket follows and
+// returns them.
+func (s *sessions) unfollowRoomThreads(c *gosocketio.Channel, roomID primitive.ObjectID) []primitive.ObjectID {
+	s.Lock()
+	defer s.Unlock()
+
+	var parents []primitive.ObjectID
+	for parentID, room := range s.threads[c.Id()] {
+		if room == roomID {
+			parents = append(parents, parentID)
+			delete(s.threads[c.Id()], parentID)
+		}
+	}
+
+	return parents
+}
+
+func roomChannel(roomID primitive.ObjectID) string {
+	return "room:" + roomID.Hex()
+}
+
+func threadChannel(parentID primitive.ObjectID) string {
+	return "thread:" + parentID.Hex()
+}
+
+// authenticateSocket binds the connection to the user of the token passed in
+// the "token" query param or the Authorization header, and joins the socket
+// to the channels of that user's rooms.
+func (h *handler) authenticateSocket(c *gosocketio.Channel) error {
+	token := c.Request().URL.Query().Get("token")
+	if a := c.RequestHeader().Get("Authorization"); token == "" && strings.HasPrefix(a, "Bearer ") {
+		token = a[7:]
+	}
+	if token == "" {
+		return service.ErrUnauthenticated
+	}
+
+	email, err := h.AuthUserEmailID(token)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.WithValue(context.Background(), service.KeyAuthUserID, email)
+	uid, err := h.AuthUserID(ctx)
+	if err != nil {
+		return err
+	}
+
+	rooms, err := h.RoomIDsForUser(uid)
+	if err != nil {
+		return err
+	}
+
+	h.sessions.add(c, session{uid, email})
+	for _, roomID := range rooms {
+		c.Join(roomChannel(roomID))
+	}
+
+	return nil
+}
+
+// socketContext returns a context carrying the user authenticated on the socket.
+func (h *handler) socketContext(c *gosocketio.Channel) context.Context {
+	ctx := context.Background()
+	if sess, ok := h.sessions.get(c); ok {
+		ctx = context.WithValue(ctx, service.KeyAuthUserID, sess.Email)
+	}
+
+	return ctx
+}
+
+func (h *handler) joinRoomChannels(userID, roomID primitive.ObjectID) {
+	for _, c := range h.sessions.channels(userID) {
+		c.Join(roomChannel(roomID))
+	}
+}
+
+func (h *handler) leaveRoomChannels(userID, roomID primitive.ObjectID) {
+	for _, c := range h.sessions.channels(userID) {
+		c.Leave(roomChannel(roomID))
+		for _, parentID := range h.sessions.unfollowRoomThreads(c, roomID) {
+			c.Leave(threadChannel(parentID))
+		}
+	}
+}
+
+// Broadcast sends the event to every socket that can read the room.
+func (h *handler) Broadcast(roomID primitive.ObjectID, event string, v interface{}) {
+	if roomID.IsZero() {
+		h.io.BroadcastToAll(event, v)
+		return
+	}
+
+	h.io.BroadcastTo(roomChannel(roomID), event, v)
+}
+
+// BroadcastThread sends the event to the sockets following the thread.
+func (h *handler) BroadcastThread(parentID primitive.ObjectID, event string, v interface{}) {
+	h.io.BroadcastTo(threadChannel(parentID), event, v)
+}
+
+// Online reports whether the user has any socket connected.
+func (h *handler) Online(userID primitive.ObjectID) bool {
+	return len(h.sessions.channels(userID)) > 0
+}
+
+// Notify sends the event to every socket of the user.
+func (h *handler) Notify(userID primitive.ObjectID, event string, v interface{}) {
+	for _, c := range h.sessions.channels(userID) {
+		go c.Emit(event, v)
+	}
+}
@@ -1,13 +1,16 @@
 package handler
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	gosocketio "github.com/ambelovsky/gosf-socketio"
 	"github.com/ambelovsky/gosf-socketio/transport"
+	"github.com/leogsouza/api-suchat/internal/command"
 	"github.com/leogsouza/api-suchat/internal/helper"
 	"github.com/leogsouza/api-suchat/internal/service"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -15,50 +18,161 @@ import (
 
 type Message struct {
 	UserID    string `json:"userId"`
+	RoomID    string `json:"roomId"`
+	ParentID  string `json:"parentId"`
 	Username  string `json:"username"`
 	UserImage string `json:"userImage"`
 	NowTime   string `json:"nowTime"`
 	Type      string `json:"type"`
 	Message   string `json:"message"`
+	// Payload is the kind specific content, see service.Payload.
+	Payload *service.Payload `json:"payload"`
+	// TTL makes the message expire after that many seconds.
+	TTL int64 `json:"ttl"`
+	// ClientMsgID makes resending the same message safe. When set, the ack
+	// is the saved message instead of "OK", or the command ack for slash
+	// commands.
+	ClientMsgID string `json:"clientMsgId"`
+}
+
+type EditMessage struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+type MessageRef struct {
+	ID string `json:"id"`
+}
+
+type ReadMessage struct {
+	RoomID string `json:"roomId"`
+	ID     string `json:"id"`
+}
+
+type SyncRoom struct {
+	RoomID string `json:"roomId"`
+	Seq    int64  `json:"seq"`
+	ID     string `json:"id"`
+}
+
+type SyncMessage struct {
+	Rooms []SyncRoom `json:"rooms"`
+}
+
+type AckMessage struct {
+	RoomID string `json:"roomId"`
+	Seq    int64  `json:"seq"`
+}
+
+type ReactionMessage struct {
+	ID    string `json:"id"`
+	Emoji string `json:"emoji"`
+}
+
+type VoteMessage struct {
+	ID     string `json:"id"`
+	Option int    `json:"option"`
 }
 
 func (h *handler) socketHandler() {
 	server := gosocketio.NewServer(transport.GetDefaultWebsocketTransport())
+	h.io = server
 
 	//handle connected
 	server.On(gosocketio.OnConnection, func(c *gosocketio.Channel) {
 		log.Println("New client connected")
 		//join them to room
-		c.Join("chat")
+		c.Join(lobbyChannel)
+		if err := h.authenticateSocket(c); err != nil {
+			log.Printf("socket %s is not authenticated: %v", c.Id(), err)
+		}
+	})
+
+	server.On(gosocketio.OnDisconnection, func(c *gosocketio.Channel) {
+		h.sessions.remove(c)
 	})
 
 	//handle custom event
 	server.On("input_message", func(c *gosocketio.Channel, msg *Message) string {
 		log.Printf("%v", msg)
-		userID, err := primitive.ObjectIDFromHex(msg.UserID)
+		userID, err := h.socketSender(c, msg)
 		if err != nil {
 			return err.Error()
 		}
 
-		createdAt, _ := time.Parse("2006-01-02T15:04:05Z07:00", msg.NowTime)
+		var roomID primitive.ObjectID
+		if msg.RoomID != "" {
+			if _, ok := h.sessions.get(c); !ok {
+				return service.ErrUnauthenticated.Error()
+			}
+			if roomID, err = primitive.ObjectIDFromHex(msg.RoomID); err != nil {
+				return err.Error()
+			}
+		}
 
 		chat := service.Chat{
-			ID:        primitive.NewObjectID(),
-			Message:   msg.Message,
-			Sender:    userID,
-			Type:      msg.Type,
-			CreatedAt: createdAt,
+			ID:          primitive.NewObjectID(),
+			Room:        roomID,
+			Message:     msg.Message,
+			Sender:      userID,
+			Type:        msg.Type,
+			Payload:     msg.Payload,
+			TTL:         msg.TTL,
+			ClientMsgID: msg.ClientMsgID,
+		}
+		// the server decides when the chat was sent, the client time is kept
+		// only for reference
+		if clientTime, err := time.Parse(time.RFC3339, msg.NowTime); err == nil {
+			chat.ClientTime = &clientTime
 		}
 
+		if msg.ParentID != "" {
+			parentID, err := primitive.ObjectIDFromHex(msg.ParentID)
+			if err != nil {
+				return err.Error()
+			}
+			chat.ParentID = &parentID
+		}
+
+		if chat.Type == "" || chat.Type == service.KindText {
+			// "//" sends a message starting with "/" instead of running it
+			if strings.HasPrefix(chat.Message, "//") {
+				chat.Message = chat.Message[1:]
+			} else if name, args, ok := command.Parse(chat.Message); ok {
+				return h.runCommand(c, chat, name, args)
+			}
+		}
+
+		//saving sends the event to all in room
 		out, err := h.SaveChat(chat)
 		if err != nil {
-			return err.Error()
+			return ackError(err)
+		}
+		h.typing.stop(roomID, userID)
+		if msg.ClientMsgID != "" {
+			b, err := json.Marshal(out)
+			if err != nil {
+				return err.Error()
+			}
+			return string(b)
 		}
-		//send event to all in room
-		server.BroadcastToAll("output_message", out)
 		return "OK"
 	})
 
+	server.On("edit_message", h.editMessage)
+	server.On("delete_message", h.deleteMessage)
+	server.On("join_thread", h.joinThread)
+	server.On("leave_thread", h.leaveThread)
+	server.On("mark_read", h.markReadEvent)
+	server.On("sync", h.syncEvent)
+	server.On("ack", h.ackEvent)
+	server.On("typing_start", h.typingStart)
+	server.On("typing_stop", h.typingStop)
+	server.On("add_reaction", h.reactionEvent(h.AddReaction))
+	server.On("remove_reaction", h.reactionEvent(h.RemoveReaction))
+	server.On("vote", h.voteEvent(h.Vote))
+	server.On("unvote", h.voteEvent(h.Unvote))
+
 	go func() {
 		//setup http server
 		serveMux := http.NewServeMux()
@@ -67,3 +181,174 @@ func (h *handler) socketHandler() {
 		log.Panic(http.ListenAndServe(socketPort, serveMux))
 	}()
 }
+
+// socketSender resolves who is sending a socket message. Authenticated
+// sockets always send as their user; anonymous ones fall back to the
+// userId in the payload.
+func (h *handler) socketSender(c *gosocketio.Channel, msg *Message) (primitive.ObjectID, error) {
+	if sess, ok := h.sessions.get(c); ok {
+		return sess.UserID, nil
+	}
+
+	return primitive.ObjectIDFromHex(msg.UserID)
+}
+
+func (h *handler) editMessage(c *gosocketio.Channel, msg *EditMessage) string {
+	chatID, err := primitive.ObjectIDFromHex(msg.ID)
+	if err != nil {
+		return err.Error()
+	}
+
+	if _, err := h.EditChat(h.socketContext(c), chatID, msg.Message); err != nil {
+		return ackError(err)
+	}
+	return "OK"
+}
+
+func (h *handler) deleteMessage(c *gosocketio.Channel, msg *MessageRef) string {
+	chatID, err := primitive.ObjectIDFromHex(msg.ID)
+	if err != nil {
+		return err.Error()
+	}
+
+	if _, err := h.DeleteChat(h.socketContext(c), chatID); err != nil {
+		return err.Error()
+	}
+	return "OK"
+}
+
+func (h *handler) reactionEvent(set reactionFunc) func(*gosocketio.Channel, *ReactionMessage) string {
+	return func(c *gosocketio.Channel, msg *ReactionMessage) string {
+		chatID, err := primitive.ObjectIDFromHex(msg.ID)
+		if err != nil {
+			return err.Error()
+		}
+
+		if _, err := set(h.socketContext(c), chatID, msg.Emoji); err != nil {
+			return err.Error()
+		}
+		return "OK"
+	}
+}
+
+// voteEvent answers with the JSON tally of the poll, including the votes of
+// the caller.
+func (h *handler) voteEvent(set voteFunc) func(*gosocketio.Channel, *VoteMessage) string {
+	return func(c *gosocketio.Channel, msg *VoteMessage) string {
+		chatID, err := primitive.ObjectIDFromHex(msg.ID)
+		if err != nil {
+			return err.Error()
+		}
+
+		update, err := set(h.socketContext(c), chatID, msg.Option)
+		if err != nil {
+			return err.Error()
+		}
+
+		b, err := json.Marshal(update)
+		if err != nil {
+			return err.Error()
+		}
+		return string(b)
+	}
+}
+
+func (h *handler) joinThread(c *gosocketio.Channel, msg *MessageRef) string {
+	parentID, err := primitive.ObjectIDFromHex(msg.ID)
+	if err != nil {
+		return err.Error()
+	}
+
+	roomID, err := h.CheckThreadAccess(h.socketContext(c), parentID)
+	if err != nil {
+		return err.Error()
+	}
+	c.Join(threadChannel(parentID))
+	h.sessions.followThread(c, parentID, roomID)
+	return "OK"
+}
+
+func (h *handler) leaveThread(c *gosocketio.Channel, msg *MessageRef) string {
+	parentID, err := primitive.ObjectIDFromHex(msg.ID)
+	if err != nil {
+		return err.Error()
+	}
+
+	c.Leave(threadChannel(parentID))
+	h.sessions.unfollowThread(c, parentID)
+	return "OK"
+}
+
+func (h *handler) markReadEvent(c *gosocketio.Channel, msg *ReadMessage) string {
+	roomID, err := primitive.ObjectIDFromHex(msg.RoomID)
+	if err != nil {
+		return err.Error()
+	}
+	chatID, err := primitive.ObjectIDFromHex(msg.ID)
+	if err != nil {
+		return err.Error()
+	}
+
+	if _, err := h.MarkRead(h.socketContext(c), roomID, chatID); err != nil {
+		return err.Error()
+	}
+	return "OK"
+}
+
+// syncEvent answers with what the client missed while disconnected. The ack
+// is the JSON list of missed chats per room.
+func (h *handler) syncEvent(c *gosocketio.Channel, msg *SyncMessage) string {
+	cursors := make([]service.SyncCursor, len(msg.Rooms))
+	for i, room := range msg.Rooms {
+		cursor, err := syncCursor(room.RoomID, room.Seq, room.ID)
+		if err != nil {
+			return err.Error()
+		}
+		cursors[i] = cursor
+	}
+
+	outs, err := h.Sync(h.socketContext(c), cursors)
+	if err != nil {
+		return err.Error()
+	}
+
+	b, err := json.Marshal(outs)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+func (h *handler) ackEvent(c *gosocketio.Channel, msg *AckMessage) string {
+	var roomID primitive.ObjectID
+	if msg.RoomID != "" {
+		var err error
+		if roomID, err = primitive.ObjectIDFromHex(msg.RoomID); err != nil {
+			return err.Error()
+		}
+	}
+
+	if err := h.AckDelivery(h.socketContext(c), roomID, msg.Seq); err != nil {
+		return err.Error()
+	}
+	return "OK"
+}
+
+// syncCursor parses a sync cursor. An empty room is the lobby.
+func syncCursor(room string, seq int64, id string) (service.SyncCursor, error) {
+	cursor := service.SyncCursor{Seq: seq}
+
+	var err error
+	if room != "" {
+		if cursor.Room, err = primitive.ObjectIDFromHex(room); err != nil {
+			return cursor, err
+		}
+	}
+	if id != "" {
+		if cursor.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return cursor, err
+		}
+	}
+
+	return cursor, nil
+}
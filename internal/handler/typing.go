@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	gosocketio "github.com/ambelovsky/gosf-socketio"
+	"github.com/leogsouza/api-suchat/internal/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// typingTimeout is how long a user stays typing without sending typing_start
+// again. Clients are expected to repeat typing_start while the user types.
+const typingTimeout = 6 * time.Second
+
+type typingKey struct {
+	Room primitive.ObjectID
+	User primitive.ObjectID
+}
+
+type typingEvent struct {
+	Room   primitive.ObjectID `json:"room,omitempty"`
+	User   primitive.ObjectID `json:"user"`
+	Typing bool               `json:"typing"`
+}
+
+// typing keeps who is typing where in memory only. Repeated starts just
+// extend the timer, so the room hears about a user once per typing burst.
+// Events are queued under the lock and sent by a single goroutine, so a
+// stop never overtakes its start.
+type typing struct {
+	sync.Mutex
+	timers map[typingKey]*time.Timer
+	events chan typingEvent
+}
+
+func newTyping(notify func(typingEvent)) *typing {
+	t := &typing{
+		timers: make(map[typingKey]*time.Timer),
+		events: make(chan typingEvent, 1024),
+	}
+	go func() {
+		for e := range t.events {
+			notify(e)
+		}
+	}()
+
+	return t
+}
+
+func (t *typing) start(roomID, userID primitive.ObjectID) {
+	key := typingKey{roomID, userID}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if timer, ok := t.timers[key]; ok {
+		timer.Reset(typingTimeout)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(typingTimeout, func() {
+		t.expire(key, timer)
+	})
+	t.timers[key] = timer
+	t.events <- typingEvent{roomID, userID, true}
+}
+
+func (t *typing) stop(roomID, userID primitive.ObjectID) {
+	key := typingKey{roomID, userID}
+
+	t.Lock()
+	defer t.Unlock()
+
+	timer, ok := t.timers[key]
+	if !ok {
+		return
+	}
+	timer.Stop()
+	delete(t.timers, key)
+	t.events <- typingEvent{roomID, userID, false}
+}
+
+func (t *typing) expire(key typingKey, timer *time.Timer) {
+	t.Lock()
+	defer t.Unlock()
+
+	// a stop, or a stop and a new start, may have raced the timer
+	if t.timers[key] != timer {
+		return
+	}
+	delete(t.timers, key)
+	t.events <- typingEvent{key.Room, key.User, false}
+}
+
+// broadcastTyping sends user_typing to everyone in the room but the typist.
+func (h *handler) broadcastTyping(e typingEvent) {
+	channel := lobbyChannel
+	if !e.Room.IsZero() {
+		channel = roomChannel(e.Room)
+	}
+
+	for _, c := range h.io.List(channel) {
+		if sess, ok := h.sessions.get(c); ok && sess.UserID == e.User {
+			continue
+		}
+		// emitting only queues the message on the socket, keeping the order
+		if c.IsAlive() {
+			c.Emit("user_typing", e)
+		}
+	}
+}
+
+type TypingMessage struct {
+	RoomID string `json:"roomId"`
+}
+
+func (h *handler) typingStart(c *gosocketio.Channel, msg *TypingMessage) string {
+	sess, roomID, err := h.typingTarget(c, msg)
+	if err != nil {
+		return err.Error()
+	}
+
+	if !roomID.IsZero() {
+		if _, err := h.GetRoom(h.socketContext(c), roomID); err != nil {
+			return err.Error()
+		}
+	}
+
+	h.typing.start(roomID, sess.UserID)
+	return "OK"
+}
+
+func (h *handler) typingStop(c *gosocketio.Channel, msg *TypingMessage) string {
+	sess, roomID, err := h.typingTarget(c, msg)
+	if err != nil {
+		return err.Error()
+	}
+
+	h.typing.stop(roomID, sess.UserID)
+	return "OK"
+}
+
+func (h *handler) typingTarget(c *gosocketio.Channel, msg *TypingMessage) (session, primitive.ObjectID, error) {
+	var roomID primitive.ObjectID
+
+	sess, ok := h.sessions.get(c)
+	if !ok {
+		return sess, roomID, service.ErrUnauthenticated
+	}
+
+	if msg.RoomID != "" {
+		var err error
+		if roomID, err = primitive.ObjectIDFromHex(msg.RoomID); err != nil {
+			return sess, roomID, err
+		}
+	}
+
+	return sess, roomID, nil
+}
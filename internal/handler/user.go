@@ -11,9 +11,20 @@ type registerUserInput struct {
 	Name     string `json:"name" validate:"required"`
 	Email    string `json:"email" validate:"required|email"`
 	Lastname string `json:"lastname" validate:""`
+	Username string `json:"username" validate:""`
 	Password string `json:"password" validate:"required|minLen:8"`
 }
 
+func (h *handler) getNotifications(w http.ResponseWriter, r *http.Request) {
+	notifications, err := h.GetNotifications(r.Context())
+	if err != nil {
+		respondServiceError(w, err)
+		return
+	}
+
+	respond(w, notifications, http.StatusOK)
+}
+
 func (h *handler) register(w http.ResponseWriter, r *http.Request) {
 	var in registerUserInput
 
@@ -30,7 +41,7 @@ func (h *handler) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.Register(in.Name, in.Email, in.Lastname, in.Password)
+	err := h.Register(in.Name, in.Email, in.Lastname, in.Username, in.Password)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
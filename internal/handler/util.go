@@ -7,6 +7,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+
+	"github.com/go-chi/chi"
+	"github.com/leogsouza/api-suchat/internal/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func respond(w http.ResponseWriter, v interface{}, statusCode int) {
@@ -50,3 +54,101 @@ func createUploadFolder(dir string) {
 		}
 	}
 }
+
+// errorStatus maps service errors to the HTTP status they are reported with.
+var errorStatus = map[error]int{
+	service.ErrUnauthenticated:          http.StatusUnauthorized,
+	service.ErrUserNotFound:             http.StatusNotFound,
+	service.ErrRoomNotFound:             http.StatusNotFound,
+	service.ErrInviteNotFound:           http.StatusNotFound,
+	service.ErrNotRoomMember:            http.StatusForbidden,
+	service.ErrNotRoomOwner:             http.StatusForbidden,
+	service.ErrPrivateRoom:              http.StatusForbidden,
+	service.ErrAlreadyRoomMember:        http.StatusConflict,
+	service.ErrOwnerCannotLeave:         http.StatusConflict,
+	service.ErrInvalidRoomName:          http.StatusUnprocessableEntity,
+	service.ErrInvalidHistoryVisibility: http.StatusUnprocessableEntity,
+	service.ErrInvalidTopic:             http.StatusUnprocessableEntity,
+	service.ErrInvalidMessageTTL:        http.StatusUnprocessableEntity,
+	service.ErrInvalidRetention:         http.StatusUnprocessableEntity,
+	service.ErrNotAdmin:                 http.StatusForbidden,
+	service.ErrInvalidExport:            http.StatusUnprocessableEntity,
+	service.ErrExportNotFound:           http.StatusNotFound,
+	service.ErrExportNotReady:           http.StatusConflict,
+	service.ErrNotSaved:                 http.StatusNotFound,
+	service.ErrInvalidNote:              http.StatusUnprocessableEntity,
+	service.ErrInvalidRemindAt:          http.StatusUnprocessableEntity,
+	service.ErrInvalidImport:            http.StatusUnprocessableEntity,
+	service.ErrImportTooLarge:           http.StatusRequestEntityTooLarge,
+	service.ErrImportOutOfOrder:         http.StatusConflict,
+	service.ErrNotPlaceholder:           http.StatusConflict,
+	service.ErrChatNotFound:             http.StatusNotFound,
+	service.ErrNotChatSender:            http.StatusForbidden,
+	service.ErrEditWindowClosed:         http.StatusForbidden,
+	service.ErrEmptyMessage:             http.StatusUnprocessableEntity,
+	service.ErrChatChanged:              http.StatusConflict,
+	service.ErrSystemMessage:            http.StatusForbidden,
+	service.ErrChatDeleted:              http.StatusGone,
+	service.ErrInvalidRole:              http.StatusUnprocessableEntity,
+	service.ErrInvalidEmoji:             http.StatusUnprocessableEntity,
+	service.ErrNotPoll:                  http.StatusUnprocessableEntity,
+	service.ErrPollClosed:               http.StatusConflict,
+	service.ErrInvalidOption:            http.StatusUnprocessableEntity,
+	service.ErrInvalidParent:            http.StatusUnprocessableEntity,
+	service.ErrInvalidUsername:          http.StatusUnprocessableEntity,
+	service.ErrUsernameTaken:            http.StatusConflict,
+	service.ErrInvalidSearch:            http.StatusBadRequest,
+	service.ErrNotRoomModerator:         http.StatusForbidden,
+	service.ErrPinLimit:                 http.StatusConflict,
+	service.ErrAlreadyPinned:            http.StatusConflict,
+	service.ErrNotPinned:                http.StatusNotFound,
+	service.ErrInvalidPinPermission:     http.StatusUnprocessableEntity,
+	service.ErrScheduledNotFound:        http.StatusNotFound,
+	service.ErrScheduledSending:         http.StatusConflict,
+	service.ErrInvalidSendAt:            http.StatusUnprocessableEntity,
+}
+
+// ValidationErrorResponse reports a message rejected by its kind schema.
+type ValidationErrorResponse struct {
+	ErrorResponse
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func validationErrorResponse(err *service.ValidationError) ValidationErrorResponse {
+	return ValidationErrorResponse{
+		ErrorResponse: ErrorResponse{http.StatusUnprocessableEntity, err.Message},
+		Field:         err.Field,
+		Reason:        err.Code,
+	}
+}
+
+// ackError is the socket acknowledgement of a failed event. Validation
+// errors are sent as JSON so clients get the same details as over REST.
+func ackError(err error) string {
+	if verr, ok := err.(*service.ValidationError); ok {
+		b, _ := json.Marshal(validationErrorResponse(verr))
+		return string(b)
+	}
+
+	return err.Error()
+}
+
+func respondServiceError(w http.ResponseWriter, err error) {
+	if verr, ok := err.(*service.ValidationError); ok {
+		respond(w, validationErrorResponse(verr), http.StatusUnprocessableEntity)
+		return
+	}
+
+	statusCode, ok := errorStatus[err]
+	if !ok {
+		respondError(w, err)
+		return
+	}
+
+	respondHTTPError(w, err, statusCode)
+}
+
+func objectIDParam(r *http.Request, name string) (primitive.ObjectID, error) {
+	return primitive.ObjectIDFromHex(chi.URLParam(r, name))
+}
@@ -1,6 +1,10 @@
 package helper
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"time"
+)
 
 func Env(key, fallbackValue string) string {
 	s := os.Getenv(key)
@@ -10,3 +14,33 @@ func Env(key, fallbackValue string) string {
 
 	return s
 }
+
+// EnvInt reads an integer from the environment.
+func EnvInt(key string, fallbackValue int) int {
+	i, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallbackValue
+	}
+
+	return i
+}
+
+// EnvBool reads a boolean such as "true" or "1" from the environment.
+func EnvBool(key string, fallbackValue bool) bool {
+	b, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallbackValue
+	}
+
+	return b
+}
+
+// EnvDuration reads a duration such as "15m" from the environment.
+func EnvDuration(key string, fallbackValue time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallbackValue
+	}
+
+	return d
+}
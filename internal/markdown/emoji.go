@@ -0,0 +1,53 @@
+package markdown
+
+// emojis maps the supported shortcodes to their emoji.
+var emojis = map[string]string{
+	"+1":               "👍",
+	"-1":               "👎",
+	"thumbsup":         "👍",
+	"thumbsdown":       "👎",
+	"smile":            "😄",
+	"smiley":           "😃",
+	"grin":             "😁",
+	"laughing":         "😆",
+	"joy":              "😂",
+	"wink":             "😉",
+	"blush":            "😊",
+	"slightly_smiling": "🙂",
+	"thinking":         "🤔",
+	"neutral_face":     "😐",
+	"confused":         "😕",
+	"cry":              "😢",
+	"sob":              "😭",
+	"angry":            "😠",
+	"scream":           "😱",
+	"sunglasses":       "😎",
+	"heart_eyes":       "😍",
+	"kissing_heart":    "😘",
+	"shrug":            "🤷",
+	"facepalm":         "🤦",
+	"pray":             "🙏",
+	"clap":             "👏",
+	"wave":             "👋",
+	"ok_hand":          "👌",
+	"muscle":           "💪",
+	"eyes":             "👀",
+	"heart":            "❤️",
+	"broken_heart":     "💔",
+	"fire":             "🔥",
+	"star":             "⭐",
+	"sparkles":         "✨",
+	"tada":             "🎉",
+	"rocket":           "🚀",
+	"100":              "💯",
+	"warning":          "⚠️",
+	"white_check_mark": "✅",
+	"x":                "❌",
+	"bug":              "🐛",
+	"coffee":           "☕",
+	"beer":             "🍺",
+	"pizza":            "🍕",
+	"bulb":             "💡",
+	"memo":             "📝",
+	"lock":             "🔒",
+}
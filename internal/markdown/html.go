@@ -0,0 +1,77 @@
+package markdown
+
+import (
+	"html"
+	"strings"
+)
+
+// HTML renders the token tree. Every piece of text is escaped and only the
+// tags produced here ever reach the output.
+func HTML(n *Node) string {
+	var b strings.Builder
+	render(&b, n)
+	return b.String()
+}
+
+// Render parses a message and returns its sanitized HTML and token tree.
+func Render(src string) (string, *Node) {
+	doc := Parse(src)
+	return HTML(doc), doc
+}
+
+func render(b *strings.Builder, n *Node) {
+	switch n.Type {
+	case Document:
+		renderChildren(b, n)
+	case Paragraph:
+		wrap(b, "p", n)
+	case CodeBlock:
+		b.WriteString("<pre><code>")
+		b.WriteString(html.EscapeString(n.Text))
+		b.WriteString("</code></pre>")
+	case List:
+		if n.Ordered {
+			wrap(b, "ol", n)
+		} else {
+			wrap(b, "ul", n)
+		}
+	case ListItem:
+		wrap(b, "li", n)
+	case Bold:
+		wrap(b, "strong", n)
+	case Italic:
+		wrap(b, "em", n)
+	case Code:
+		b.WriteString("<code>")
+		b.WriteString(html.EscapeString(n.Text))
+		b.WriteString("</code>")
+	case Link:
+		b.WriteString(`<a href="`)
+		b.WriteString(html.EscapeString(n.URL))
+		b.WriteString(`" rel="noopener noreferrer nofollow" target="_blank">`)
+		renderChildren(b, n)
+		b.WriteString("</a>")
+	case Emoji:
+		b.WriteString(`<span class="emoji" title=":`)
+		b.WriteString(html.EscapeString(n.Name))
+		b.WriteString(`:">`)
+		b.WriteString(html.EscapeString(n.Text))
+		b.WriteString("</span>")
+	case LineBreak:
+		b.WriteString("<br>")
+	default:
+		b.WriteString(html.EscapeString(n.Text))
+	}
+}
+
+func wrap(b *strings.Builder, tag string, n *Node) {
+	b.WriteString("<" + tag + ">")
+	renderChildren(b, n)
+	b.WriteString("</" + tag + ">")
+}
+
+func renderChildren(b *strings.Builder, n *Node) {
+	for _, c := range n.Children {
+		render(b, c)
+	}
+}
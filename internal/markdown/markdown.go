@@ -0,0 +1,260 @@
+// Package markdown parses the safe Markdown subset allowed in chat messages
+// and renders it to sanitized HTML.
+//
+// Supported syntax: **bold**, *italics* or _italics_, `code`, fenced code
+// blocks, [links](https://example.com), bare http(s) URLs, "-", "*" and "1."
+// lists and :emoji: shortcodes. A backslash before a markup character keeps
+// it as is. Anything else is kept as plain text.
+package markdown
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Node types of the token tree.
+const (
+	Document  = "document"
+	Paragraph = "paragraph"
+	CodeBlock = "code_block"
+	List      = "list"
+	ListItem  = "list_item"
+	Text      = "text"
+	Bold      = "bold"
+	Italic    = "italic"
+	Code      = "code"
+	Link      = "link"
+	Emoji     = "emoji"
+	LineBreak = "line_break"
+)
+
+// Node is an element of the token tree.
+type Node struct {
+	Type     string  `json:"type"`
+	Text     string  `json:"text,omitempty"`
+	URL      string  `json:"url,omitempty"`
+	Name     string  `json:"name,omitempty"`
+	Ordered  bool    `json:"ordered,omitempty"`
+	Children []*Node `json:"children,omitempty"`
+}
+
+// escapable are the characters a backslash can escape.
+const escapable = "\\`*_[]:"
+
+var (
+	bulletItem  = regexp.MustCompile(`^\s*[-*]\s+(.*)$`)
+	orderedItem = regexp.MustCompile(`^\s*\d{1,9}[.)]\s+(.*)$`)
+	shortcode   = regexp.MustCompile(`^:([a-z0-9_+-]+):`)
+	bareURL     = regexp.MustCompile(`^https?://[^\s<>"]+`)
+)
+
+// Parse builds the token tree of a message.
+func Parse(src string) *Node {
+	doc := &Node{Type: Document}
+	lines := strings.Split(strings.Replace(src, "\r\n", "\n", -1), "\n")
+
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case strings.HasPrefix(strings.TrimSpace(line), "```"):
+			var code []string
+			i++
+			for i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```") {
+				code = append(code, lines[i])
+				i++
+			}
+			i++ // closing fence
+			doc.Children = append(doc.Children, &Node{Type: CodeBlock, Text: strings.Join(code, "\n")})
+
+		case bulletItem.MatchString(line) || orderedItem.MatchString(line):
+			ordered := orderedItem.MatchString(line)
+			item := bulletItem
+			if ordered {
+				item = orderedItem
+			}
+
+			list := &Node{Type: List, Ordered: ordered}
+			for i < len(lines) && item.MatchString(lines[i]) {
+				content := item.FindStringSubmatch(lines[i])[1]
+				list.Children = append(list.Children, &Node{Type: ListItem, Children: parseInline(content)})
+				i++
+			}
+			doc.Children = append(doc.Children, list)
+
+		default:
+			p := &Node{Type: Paragraph}
+			for i < len(lines) && strings.TrimSpace(lines[i]) != "" &&
+				!strings.HasPrefix(strings.TrimSpace(lines[i]), "```") &&
+				!bulletItem.MatchString(lines[i]) && !orderedItem.MatchString(lines[i]) {
+				if len(p.Children) > 0 {
+					p.Children = append(p.Children, &Node{Type: LineBreak})
+				}
+				p.Children = append(p.Children, parseInline(lines[i])...)
+				i++
+			}
+			doc.Children = append(doc.Children, p)
+		}
+	}
+
+	return doc
+}
+
+// parseInline parses the inline markup of a single line.
+func parseInline(s string) []*Node {
+	var (
+		nodes []*Node
+		text  strings.Builder
+	)
+
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, &Node{Type: Text, Text: text.String()})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		rest := s[i:]
+
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.IndexByte(escapable, rest[1]) >= 0:
+			text.WriteByte(rest[1])
+			i += 2
+			continue
+
+		case rest[0] == '`':
+			if end := strings.IndexByte(rest[1:], '`'); end > 0 {
+				flush()
+				nodes = append(nodes, &Node{Type: Code, Text: rest[1 : end+1]})
+				i += end + 2
+				continue
+			}
+
+		case strings.HasPrefix(rest, "**"):
+			if end := strings.Index(rest[2:], "**"); end > 0 {
+				flush()
+				nodes = append(nodes, &Node{Type: Bold, Children: parseInline(rest[2 : end+2])})
+				i += end + 4
+				continue
+			}
+
+		case rest[0] == '*' || rest[0] == '_':
+			if end := closingEmphasis(s, i); end > 0 {
+				flush()
+				nodes = append(nodes, &Node{Type: Italic, Children: parseInline(s[i+1 : end])})
+				i = end + 1
+				continue
+			}
+
+		case rest[0] == '[':
+			if label, href, n, ok := parseLink(rest); ok {
+				flush()
+				nodes = append(nodes, &Node{Type: Link, URL: href, Children: parseInline(label)})
+				i += n
+				continue
+			}
+
+		case rest[0] == ':':
+			if m := shortcode.FindStringSubmatch(rest); m != nil {
+				if e, ok := emojis[m[1]]; ok {
+					flush()
+					nodes = append(nodes, &Node{Type: Emoji, Name: m[1], Text: e})
+					i += len(m[0])
+					continue
+				}
+			}
+
+		case rest[0] == 'h' && (i == 0 || !isWordByte(s[i-1])):
+			if m := bareURL.FindString(rest); m != "" {
+				m = strings.TrimRight(m, ".,;:!?)")
+				if href, ok := safeURL(m); ok {
+					flush()
+					nodes = append(nodes, &Node{Type: Link, URL: href, Children: []*Node{{Type: Text, Text: m}}})
+					i += len(m)
+					continue
+				}
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(rest)
+		text.WriteRune(r)
+		i += size
+	}
+	flush()
+
+	return nodes
+}
+
+// closingEmphasis finds where the emphasis opened at s[start] closes. Word
+// characters around the markers don't count, so snake_case stays as is.
+func closingEmphasis(s string, start int) int {
+	marker := s[start]
+	if start > 0 && isWordByte(s[start-1]) {
+		return -1
+	}
+	if start+1 >= len(s) || s[start+1] == ' ' {
+		return -1
+	}
+
+	for j := start + 2; j < len(s); j++ {
+		if s[j] != marker || s[j-1] == ' ' {
+			continue
+		}
+		if j+1 < len(s) && isWordByte(s[j+1]) {
+			continue
+		}
+		return j
+	}
+
+	return -1
+}
+
+// parseLink parses "[label](url)" at the start of s.
+func parseLink(s string) (label, href string, n int, ok bool) {
+	closeLabel := strings.Index(s, "](")
+	if closeLabel < 1 {
+		return "", "", 0, false
+	}
+	closeURL := strings.IndexByte(s[closeLabel+2:], ')')
+	if closeURL < 1 {
+		return "", "", 0, false
+	}
+
+	href, ok = safeURL(s[closeLabel+2 : closeLabel+2+closeURL])
+	if !ok {
+		return "", "", 0, false
+	}
+
+	return s[1:closeLabel], href, closeLabel + 3 + closeURL, true
+}
+
+// safeURL only lets through absolute http, https and mailto URLs.
+func safeURL(raw string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		if u.Host == "" {
+			return "", false
+		}
+	case "mailto":
+	default:
+		return "", false
+	}
+
+	return u.String(), true
+}
+
+func isWordByte(b byte) bool {
+	return b < utf8.RuneSelf && (unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b)) || b == '_')
+}
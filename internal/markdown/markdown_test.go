@@ -0,0 +1,91 @@
+package markdown
+
+import "testing"
+
+func TestRenderSanitizes(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"script", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+		{"img onerror", "<img src=x onerror=alert(1)>", "<p>&lt;img src=x onerror=alert(1)&gt;</p>"},
+		{"javascript link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>"},
+		{"mixed case javascript link", "[x](JaVaScRiPt:alert(1))", "<p>[x](JaVaScRiPt:alert(1))</p>"},
+		{"data link", "[x](data:text/html,hi)", "<p>[x](data:text/html,hi)</p>"},
+		{"protocol relative link", "[x](//evil.com/a)", "<p>[x](//evil.com/a)</p>"},
+		{
+			"quotes in href",
+			`[x](https://a.b/?q="><script>)`,
+			`<p><a href="https://a.b/?q=&#34;&gt;&lt;script&gt;" rel="noopener noreferrer nofollow" target="_blank">x</a></p>`,
+		},
+		{
+			"apostrophe in href",
+			"[x](https://a.b/it's)",
+			`<p><a href="https://a.b/it&#39;s" rel="noopener noreferrer nofollow" target="_blank">x</a></p>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := Render(tt.src); got != tt.want {
+				t.Errorf("Render(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+		ok   bool
+	}{
+		{"https://a.b/c", "https://a.b/c", true},
+		{" http://a.b ", "http://a.b", true},
+		{"mailto:a@b.com", "mailto:a@b.com", true},
+		{"javascript:alert(1)", "", false},
+		{"JaVaScRiPt:alert(1)", "", false},
+		{"data:text/html,<script>", "", false},
+		{"//evil.com/a", "", false},
+		{"/relative", "", false},
+		{"https:///no-host", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, ok := safeURL(tt.raw)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("safeURL(%q) = %q, %v, want %q, %v", tt.raw, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRenderEscapes(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"emphasis", `a \*b\* c`, "<p>a *b* c</p>"},
+		{"underscores", `\_x\_`, "<p>_x_</p>"},
+		{"backslash", `a \\ b`, `<p>a \ b</p>`},
+		{"escaped backslash before emphasis", `\\*x*`, `<p>\<em>x</em></p>`},
+		{"shrug", `¯\\\_(ツ)\_/¯`, `<p>¯\_(ツ)_/¯</p>`},
+		{"code", "\\`code\\`", "<p>`code`</p>"},
+		{"link", `\[x\]`, "<p>[x]</p>"},
+		{"autolink", `https\://a.b`, "<p>https://a.b</p>"},
+		{"not escapable", `\a`, `<p>\a</p>`},
+		{"trailing", `trailing \`, `<p>trailing \</p>`},
+		{"unescaped", `*em*`, "<p><em>em</em></p>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := Render(tt.src); got != tt.want {
+				t.Errorf("Render(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
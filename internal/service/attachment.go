@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// UploadPath is the directory where uploaded files are stored and served from
+// under the "files/" URL prefix.
+const UploadPath = "./uploads"
+
+var uploadRef = regexp.MustCompile(`files/([0-9a-f]+\.[A-Za-z0-9]+)`)
+
+// ErrUploadNotFound used when the upload wasn't found on the db.
+var ErrUploadNotFound = errors.New("upload not found")
+
+// Upload is a file uploaded by a user.
+type Upload struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Name        string             `bson:"name" json:"name"`
+	Owner       primitive.ObjectID `bson:"owner" json:"owner"`
+	ContentType string             `bson:"content_type" json:"content_type"`
+	Size        int64              `bson:"size" json:"size"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// SaveUpload records a file stored under UploadPath as uploaded by the
+// authenticated user.
+func (s *Service) SaveUpload(ctx context.Context, name, contentType string, size int64) (Upload, error) {
+	var upload Upload
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return upload, err
+	}
+
+	upload = Upload{
+		ID:          primitive.NewObjectID(),
+		Name:        name,
+		Owner:       uid,
+		ContentType: contentType,
+		Size:        size,
+		CreatedAt:   time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = s.db.Collection("uploads").InsertOne(ctx, upload)
+
+	return upload, err
+}
+
+func (s *Service) findUpload(name string) (Upload, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	upload := Upload{}
+	err := s.db.Collection("uploads").FindOne(ctx, bson.M{"name": name}).Decode(&upload)
+	if err == mongo.ErrNoDocuments {
+		return upload, ErrUploadNotFound
+	}
+
+	return upload, err
+}
+
+// attachments lists the uploaded files referenced by a chat, in its message
+// or as the file of its payload.
+func attachments(chat Chat) []string {
+	var names []string
+	for _, m := range uploadRef.FindAllStringSubmatch(chat.Message, -1) {
+		names = append(names, m[1])
+	}
+	if chat.Payload != nil {
+		if m := uploadRef.FindStringSubmatch(chat.Payload.File); m != nil {
+			names = append(names, m[1])
+		}
+	}
+
+	return names
+}
+
+// orphanAttachments lists the uploaded files of the chat that no other
+// visible chat references anymore.
+func (s *Service) orphanAttachments(chat Chat) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var names []string
+	for _, name := range attachments(chat) {
+		filter := bson.M{
+			"_id":        bson.M{"$ne": chat.ID},
+			"deleted_at": bson.M{"$exists": false},
+			"$or": bson.A{
+				bson.M{"message": bson.M{"$regex": regexp.QuoteMeta("files/" + name)}},
+				bson.M{"payload.file": "files/" + name},
+			},
+		}
+		n, err := s.db.Collection("chats").CountDocuments(ctx, filter)
+		if err != nil {
+			log.Printf("could not check references to %s: %v", name, err)
+			continue
+		}
+		if n == 0 {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// removeOrphanAttachments deletes the uploaded files of the chat that no
+// other visible chat references anymore and returns their names.
+func (s *Service) removeOrphanAttachments(chat Chat) []string {
+	names := s.orphanAttachments(chat)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(UploadPath, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("could not remove attachment %s: %v", name, err)
+		}
+		if _, err := s.db.Collection("uploads").DeleteOne(ctx, bson.M{"name": name}); err != nil {
+			log.Printf("could not forget upload %s: %v", name, err)
+		}
+	}
+
+	return names
+}
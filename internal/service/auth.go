@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -50,7 +52,9 @@ func (s *Service) Login(email, password string) (UserLoginOutput, error) {
 	collection := s.db.Collection("users")
 	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
 	u := User{}
-	err := collection.FindOne(ctx, bson.M{"email": email}).Decode(&u)
+	// accounts from before emails were normalized keep the email as typed
+	filter := bson.M{"email": bson.M{"$in": bson.A{email, normalizeEmail(email)}}, "placeholder": bson.M{"$ne": true}}
+	err := collection.FindOne(ctx, filter).Decode(&u)
 	if err != nil {
 
 		return out, err
@@ -187,3 +191,37 @@ func (s *Service) validateUserTokenExpiration(token, email string, expiresAt tim
 
 	return nil
 }
+
+// AuthUserID retrieves the ID of the user authenticated in the context
+func (s *Service) AuthUserID(ctx context.Context) (primitive.ObjectID, error) {
+	email, ok := ctx.Value(KeyAuthUserID).(string)
+	if !ok {
+		return primitive.NilObjectID, ErrUnauthenticated
+	}
+
+	u, err := s.findUserByEmail(email)
+	if err == mongo.ErrNoDocuments {
+		return primitive.NilObjectID, ErrUserNotFound
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return u.ID, nil
+}
+
+// isAdmin reports whether the authenticated user is one of the configured
+// admins.
+func (s *Service) isAdmin(ctx context.Context) bool {
+	email, ok := ctx.Value(KeyAuthUserID).(string)
+	if !ok {
+		return false
+	}
+	for _, admin := range s.config.Admins {
+		if strings.EqualFold(strings.TrimSpace(admin), email) {
+			return true
+		}
+	}
+
+	return false
+}
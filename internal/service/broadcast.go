@@ -0,0 +1,63 @@
+package service
+
+import (
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Broadcaster delivers service events to the connected clients.
+type Broadcaster interface {
+	// Broadcast sends the event to everyone who can read the room. The zero
+	// room is the public lobby.
+	Broadcast(roomID primitive.ObjectID, event string, v interface{})
+	// BroadcastThread sends the event to everyone following the thread.
+	BroadcastThread(parentID primitive.ObjectID, event string, v interface{})
+	// Notify sends the event to every connection of the user.
+	Notify(userID primitive.ObjectID, event string, v interface{})
+	// Online reports whether the user has any connection open.
+	Online(userID primitive.ObjectID) bool
+}
+
+type nopBroadcaster struct{}
+
+func (nopBroadcaster) Broadcast(primitive.ObjectID, string, interface{})       {}
+func (nopBroadcaster) BroadcastThread(primitive.ObjectID, string, interface{}) {}
+func (nopBroadcaster) Notify(primitive.ObjectID, string, interface{})          {}
+func (nopBroadcaster) Online(primitive.ObjectID) bool                          { return false }
+
+// SetBroadcaster sets where the service delivers its events.
+func (s *Service) SetBroadcaster(b Broadcaster) {
+	s.events = b
+}
+
+// publishChat fans a newly saved chat out: thread replies go to the thread
+// followers with an updated summary for the room, everything else goes to the
+// room. The sender has read their own message, so a receipt follows.
+func (s *Service) publishChat(out chatOutput) {
+	if out.ParentID != nil {
+		s.events.BroadcastThread(*out.ParentID, "thread_reply", out)
+
+		summary, err := s.GetThreadSummary(*out.ParentID)
+		if err != nil {
+			log.Printf("could not load thread %s: %v", out.ParentID.Hex(), err)
+		} else {
+			s.events.Broadcast(out.Room, "thread_updated", summary)
+		}
+	} else {
+		s.events.Broadcast(out.Room, "output_message", out)
+	}
+
+	if out.Room.IsZero() {
+		return
+	}
+
+	receipt, advanced, err := s.markRead(out.Room, out.Sender.ID, out.ID, out.Seq)
+	if err != nil {
+		log.Printf("could not mark %s as read: %v", out.ID.Hex(), err)
+		return
+	}
+	if advanced {
+		s.events.Broadcast(out.Room, "read_receipt", receipt)
+	}
+}
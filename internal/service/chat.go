@@ -5,36 +5,129 @@ import (
 	"log"
 	"time"
 
+	"github.com/leogsouza/api-suchat/internal/markdown"
+	"github.com/leogsouza/api-suchat/internal/unfurl"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Chat struct {
-	ID        primitive.ObjectID `bson:"_id" json:"id"`
-	Sender    primitive.ObjectID `bson:"sender" json:"sender"`
-	Message   string             `bson:"message" json:"message"`
-	Type      string             `bson:"type" json:"type"`
-	CreatedAt time.Time          `bson:"created_at" json:"created_at,omitempty"`
+	ID       primitive.ObjectID  `bson:"_id" json:"id"`
+	Room     primitive.ObjectID  `bson:"room,omitempty" json:"room,omitempty"`
+	ParentID *primitive.ObjectID `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	Sender   primitive.ObjectID  `bson:"sender" json:"sender"`
+	// ClientMsgID is set by the client so resending the chat doesn't
+	// duplicate it. It is unique per sender.
+	ClientMsgID string `bson:"client_msg_id,omitempty" json:"client_msg_id,omitempty"`
+	// ScheduledID is the scheduled chat this chat was sent from.
+	ScheduledID *primitive.ObjectID `bson:"scheduled_id,omitempty" json:"-"`
+	Message     string              `bson:"message" json:"message"`
+	Type        string              `bson:"type" json:"type"`
+	Payload     *Payload            `bson:"payload,omitempty" json:"payload,omitempty"`
+	// Seq orders the chats of a room. It and CreatedAt are set by the server,
+	// ClientTime is when the client says it sent the chat.
+	Seq        int64               `bson:"seq,omitempty" json:"seq,omitempty"`
+	CreatedAt  time.Time           `bson:"created_at" json:"created_at,omitempty"`
+	ClientTime *time.Time          `bson:"client_time,omitempty" json:"client_time,omitempty"`
+	EditedAt   *time.Time          `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+	DeletedAt  *time.Time          `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	DeletedBy  *primitive.ObjectID `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`
+	// UpdatedAt is the last time the chat, its reactions or its poll changed
+	// after it was sent, so syncs can send the changes a client missed.
+	UpdatedAt *time.Time `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+	// TTL is how many seconds the message lives once sent, zero for the room
+	// default. ExpiresAt is set from it when the message is saved.
+	TTL       int64      `bson:"ttl,omitempty" json:"ttl,omitempty"`
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	// Mentions are the users the message mentions.
+	Mentions        []primitive.ObjectID `bson:"mentions,omitempty" json:"mentions,omitempty"`
+	MentionEntities []Mention            `bson:"mention_entities,omitempty" json:"mention_entities,omitempty"`
+	// Previews are attached in the background once the links are unfurled.
+	Previews []unfurl.Preview `bson:"previews,omitempty" json:"previews,omitempty"`
 }
 
 type chatOutput struct {
-	ID        primitive.ObjectID `json:"id"`
-	Sender    UserChat           `json:"sender"`
-	Message   string             `json:"message"`
-	Type      string             `json:"type"`
-	CreatedAt time.Time          `json:"created_at,omitempty"`
+	ID          primitive.ObjectID  `json:"id"`
+	Room        primitive.ObjectID  `json:"room,omitempty"`
+	ParentID    *primitive.ObjectID `json:"parent_id,omitempty"`
+	Sender      UserChat            `json:"sender"`
+	ClientMsgID string              `json:"client_msg_id,omitempty"`
+	Message     string              `json:"message"`
+	Type        string              `json:"type"`
+	Payload     *Payload            `json:"payload,omitempty"`
+	Seq         int64               `json:"seq,omitempty"`
+	CreatedAt   time.Time           `json:"created_at,omitempty"`
+	ClientTime  *time.Time          `json:"client_time,omitempty"`
+	EditedAt    *time.Time          `json:"edited_at,omitempty"`
+	DeletedAt   *time.Time          `json:"deleted_at,omitempty"`
+	UpdatedAt   *time.Time          `json:"updated_at,omitempty"`
+	DeletedBy   *primitive.ObjectID `json:"deleted_by,omitempty"`
+	ExpiresAt   *time.Time          `json:"expires_at,omitempty"`
+	Reactions   []reactionOutput    `json:"reactions,omitempty"`
+	Thread      *ThreadSummary      `json:"thread,omitempty"`
+	Poll        *pollOutput         `json:"poll,omitempty"`
+	Mentions    []mentionOutput     `json:"mentions,omitempty"`
+	Previews    []unfurl.Preview    `json:"previews,omitempty"`
+	// HTML and Tokens are the rendered Markdown of Message, which stays raw
+	// so it can be edited.
+	HTML   string         `json:"html,omitempty"`
+	Tokens *markdown.Node `json:"tokens,omitempty"`
+	// Redacted chats are shown to people who can't read them, without
+	// their content.
+	Redacted bool `json:"redacted,omitempty"`
 }
 
+// SaveChat stores a chat and sends it to the room. A chat resent with the
+// client message ID of an earlier one isn't saved again, the earlier one is
+// returned instead.
 func (s *Service) SaveChat(c Chat) (chatOutput, error) {
 
 	var chout chatOutput
 
+	if err := s.validateChat(&c); err != nil {
+		return chout, err
+	}
+	if err := s.checkRoomAccess(c.Room, c.Sender); err != nil {
+		return chout, err
+	}
+	// only once the sender could send it, since anonymous sockets pick
+	// their own sender
+	if original, ok, err := s.findClientChat(c); err != nil || ok {
+		return original, err
+	}
+	if err := s.validateParent(c); err != nil {
+		return chout, err
+	}
+	if err := s.setExpiry(&c); err != nil {
+		return chout, err
+	}
+
+	mentions, mentioned, err := s.resolveMentions(c.Room, c.Sender, c.Message)
+	if err != nil {
+		return chout, err
+	}
+	c.MentionEntities = mentions
+	c.Mentions = mentioned
+
+	if c.Seq, err = s.nextSeq(c.Room); err != nil {
+		return chout, err
+	}
+	c.CreatedAt = time.Now()
+
 	collection := s.db.Collection("chats")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	result, err := collection.InsertOne(ctx, c)
 	var chat Chat
 	if err != nil {
+		if c.ClientMsgID != "" && isDuplicateKeyError(err) {
+			// lost the race against a concurrent resend
+			if original, ok, err := s.findClientChat(c); err != nil || ok {
+				return original, err
+			}
+		}
 		return chout, err
 	}
 
@@ -43,31 +136,48 @@ func (s *Service) SaveChat(c Chat) (chatOutput, error) {
 		return chout, err
 	}
 
-	u, err := s.findUserChatById(chat.Sender)
+	chout, err = s.chatOutput(chat)
 	if err != nil {
 		return chout, err
 	}
 
-	chout = chatOutput{
-		chat.ID,
-		u,
-		chat.Message,
-		chat.Type,
-		chat.CreatedAt,
-	}
+	s.publishChat(chout)
+	s.notifyMentions(chout, chat.Mentions)
+	s.unfurlChat(chat)
 
 	return chout, nil
 }
 
-func (s *Service) GetChats() ([]chatOutput, error) {
+// GetChats retrieves the history of a room the authenticated user can read.
+// The zero room is the public lobby. Thread replies are left out, see GetThread.
+func (s *Service) GetChats(ctx context.Context, roomID primitive.ObjectID) ([]chatOutput, error) {
+
+	var chats []Chat
+
+	uid, _ := s.AuthUserID(ctx)
+	filter := bson.M{
+		"room":       bson.M{"$exists": false},
+		"parent_id":  bson.M{"$exists": false},
+		"expires_at": notExpired(),
+	}
+	if !roomID.IsZero() {
+		_, since, err := s.roomAccess(roomID, uid)
+		if err != nil {
+			return nil, err
+		}
+
+		filter["room"] = roomID
+		if !since.IsZero() {
+			filter["created_at"] = bson.M{"$gte": since}
+		}
+	}
 
-	var chats []chatOutput
 	collection := s.db.Collection("chats")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	cur, err := collection.Find(ctx, bson.M{})
+	cur, err := collection.Find(ctx, filter, options.Find().SetSort(historyOrder()))
 	if err != nil {
-		return chats, err
+		return nil, err
 	}
 	defer cur.Close(ctx)
 
@@ -78,25 +188,145 @@ func (s *Service) GetChats() ([]chatOutput, error) {
 			log.Fatal(err)
 		}
 
-		u, err := s.findUserChatById(chat.Sender)
-		if err != nil {
-			return chats, err
+		chats = append(chats, chat)
+	}
+
+	if err := cur.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	return s.chatOutputs(uid, chats)
+}
+
+func (s *Service) chatOutput(chat Chat) (chatOutput, error) {
+	outs, err := s.chatOutputs(primitive.NilObjectID, []Chat{chat})
+	if err != nil {
+		return chatOutput{}, err
+	}
+
+	return outs[0], nil
+}
+
+// chatOutputs hydrates the chats with their senders and reactions as seen by
+// the viewer.
+func (s *Service) chatOutputs(viewer primitive.ObjectID, chats []Chat) ([]chatOutput, error) {
+	outs := make([]chatOutput, 0, len(chats))
+
+	ids := make([]primitive.ObjectID, len(chats))
+	for i, chat := range chats {
+		ids[i] = chat.ID
+	}
+
+	reactions, err := s.reactionsFor(ids, viewer)
+	if err != nil {
+		return outs, err
+	}
+
+	threads, err := s.threadSummaries(ids)
+	if err != nil {
+		return outs, err
+	}
+
+	polls, err := s.pollsFor(chats, viewer)
+	if err != nil {
+		return outs, err
+	}
+
+	senders := make(map[primitive.ObjectID]UserChat)
+	for _, chat := range chats {
+		u, ok := senders[chat.Sender]
+		if !ok {
+			if u, err = s.findUserChatById(chat.Sender); err != nil {
+				return outs, err
+			}
+			senders[chat.Sender] = u
 		}
 
 		chout := chatOutput{
-			chat.ID,
-			u,
-			chat.Message,
-			chat.Type,
-			chat.CreatedAt,
+			ID:          chat.ID,
+			Room:        chat.Room,
+			ParentID:    chat.ParentID,
+			Sender:      u,
+			ClientMsgID: chat.ClientMsgID,
+			Message:     chat.Message,
+			Type:        chat.Type,
+			Payload:     chat.Payload,
+			Seq:         chat.Seq,
+			CreatedAt:   chat.CreatedAt,
+			ClientTime:  chat.ClientTime,
+			EditedAt:    chat.EditedAt,
+			DeletedAt:   chat.DeletedAt,
+			DeletedBy:   chat.DeletedBy,
+			UpdatedAt:   chat.UpdatedAt,
+			ExpiresAt:   chat.ExpiresAt,
+			Reactions:   reactions[chat.ID],
+			Poll:        polls[chat.ID],
+			Previews:    chat.Previews,
+		}
+
+		chout.HTML, chout.Tokens = markdown.Render(chat.Message)
+
+		if chout.Mentions, err = s.mentionOutputs(chat.MentionEntities, senders); err != nil {
+			return outs, err
+		}
+
+		if thread, ok := threads[chat.ID]; ok {
+			thread.Room = chat.Room
+			chout.Thread = &thread
+		}
+
+		// deleted chats are rendered as tombstones without content
+		if chat.DeletedAt != nil {
+			chout.Message = ""
+			chout.EditedAt = nil
+			chout.Reactions = nil
+			chout.Mentions = nil
+			chout.Previews = nil
+			chout.Payload = nil
+			chout.Poll = nil
+			chout.HTML, chout.Tokens = "", nil
 		}
 
-		chats = append(chats, chout)
+		outs = append(outs, chout)
 	}
 
-	if err := cur.Err(); err != nil {
-		log.Fatal(err)
+	return outs, nil
+}
+
+// findClientChat looks for a chat the sender already sent with the same
+// client message ID. The ID must not be reused for another room or thread.
+func (s *Service) findClientChat(c Chat) (chatOutput, bool, error) {
+	if c.ClientMsgID == "" {
+		return chatOutput{}, false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var chat Chat
+	filter := bson.M{"sender": c.Sender, "client_msg_id": c.ClientMsgID}
+	err := s.db.Collection("chats").FindOne(ctx, filter).Decode(&chat)
+	if err == mongo.ErrNoDocuments {
+		return chatOutput{}, false, nil
+	}
+	if err != nil {
+		return chatOutput{}, false, err
+	}
+	if err := sameClientChat(chat, c); err != nil {
+		return chatOutput{}, false, err
+	}
+
+	out, err := s.chatOutput(chat)
+	return out, err == nil, err
+}
+
+// sameClientChat checks that a resent chat goes to the room and thread the
+// original went to.
+func sameClientChat(original, c Chat) error {
+	sameParent := original.ParentID == nil && c.ParentID == nil ||
+		original.ParentID != nil && c.ParentID != nil && *original.ParentID == *c.ParentID
+	if original.Room != c.Room || !sameParent {
+		return invalid("client_msg_id", "duplicate", "client message id already used")
 	}
 
-	return chats, nil
+	return nil
 }
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrChatDeleted used when changing or reading a deleted chat.
+var ErrChatDeleted = errors.New("message was deleted")
+
+// DeleteChat soft deletes a chat. Senders can delete their own messages and
+// room owners and moderators can delete any message of their room. System
+// messages record what happened in the room, so only moderators can delete
+// them.
+func (s *Service) DeleteChat(ctx context.Context, chatID primitive.ObjectID) (chatOutput, error) {
+	var chout chatOutput
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return chout, err
+	}
+
+	chat, err := s.findChat(chatID)
+	if err != nil {
+		return chout, err
+	}
+	if chat.DeletedAt != nil {
+		return chout, ErrChatDeleted
+	}
+	moderator := s.isRoomModerator(chat.Room, uid)
+	if chat.Type == KindSystem && !moderator {
+		return chout, ErrSystemMessage
+	}
+	if chat.Sender != uid && !moderator {
+		return chout, ErrNotChatSender
+	}
+
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{"_id": chat.ID, "deleted_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"deleted_at": now, "deleted_by": uid, "updated_at": now}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var deleted Chat
+	err = s.db.Collection("chats").FindOneAndUpdate(ctx, filter, update, opts).Decode(&deleted)
+	if err == mongo.ErrNoDocuments {
+		return chout, ErrChatDeleted
+	}
+	if err != nil {
+		return chout, err
+	}
+
+	s.removeOrphanAttachments(chat)
+
+	if unpinned, err := s.removePin(chat.Room, chat.ID); err != nil {
+		log.Printf("could not unpin deleted chat %s: %v", chat.ID.Hex(), err)
+	} else if unpinned {
+		s.events.Broadcast(chat.Room, "message_unpinned", Pin{Room: chat.Room, Chat: chat.ID, PinnedBy: uid, PinnedAt: now})
+	}
+
+	chout, err = s.chatOutput(deleted)
+	if err != nil {
+		return chout, err
+	}
+
+	s.events.Broadcast(chout.Room, "message_deleted", chout)
+
+	return chout, nil
+}
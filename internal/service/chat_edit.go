@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrChatNotFound used when the chat wasn't found on the db.
+	ErrChatNotFound = errors.New("chat not found")
+	// ErrNotChatSender used when someone other than the sender changes a chat.
+	ErrNotChatSender = errors.New("only the sender can change the message")
+	// ErrEditWindowClosed used when the chat is too old to be edited.
+	ErrEditWindowClosed = errors.New("message can no longer be edited")
+	// ErrEmptyMessage used when the message has no content.
+	ErrEmptyMessage = errors.New("message cannot be empty")
+	// ErrSystemMessage used when changing a message sent by the server.
+	ErrSystemMessage = errors.New("system messages cannot be changed")
+	// ErrChatChanged used when the chat changed while it was being edited.
+	ErrChatChanged = errors.New("message changed while editing, try again")
+)
+
+// ChatEdit is a previous version of an edited chat.
+type ChatEdit struct {
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	Chat     primitive.ObjectID `bson:"chat" json:"chat"`
+	Message  string             `bson:"message" json:"message"`
+	EditedAt time.Time          `bson:"edited_at" json:"edited_at"`
+}
+
+// EditChat replaces the message of a chat sent by the authenticated user,
+// keeping the previous version in the edit history.
+func (s *Service) EditChat(ctx context.Context, chatID primitive.ObjectID, message string) (chatOutput, error) {
+	var chout chatOutput
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return chout, err
+	}
+
+	if strings.TrimSpace(message) == "" {
+		return chout, ErrEmptyMessage
+	}
+	if utf8.RuneCountInString(message) > maxMessageLength {
+		return chout, invalid("message", "too_long", "message is too long")
+	}
+
+	chat, err := s.findChat(chatID)
+	if err != nil {
+		return chout, err
+	}
+	if chat.DeletedAt != nil {
+		return chout, ErrChatDeleted
+	}
+	if chat.Type == KindSystem {
+		return chout, ErrSystemMessage
+	}
+	if chat.Sender != uid {
+		return chout, ErrNotChatSender
+	}
+	if err := s.checkRoomAccess(chat.Room, uid); err != nil {
+		return chout, err
+	}
+	// the ObjectID is generated by the server, unlike created_at
+	if time.Since(chat.ID.Timestamp()) > s.config.EditWindow {
+		return chout, ErrEditWindowClosed
+	}
+	if chat.Message == message {
+		return s.chatOutput(chat)
+	}
+
+	mentions, mentioned, err := s.resolveMentions(chat.Room, chat.Sender, message)
+	if err != nil {
+		return chout, err
+	}
+
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// keep the previous version first, so an edit is never saved without it
+	edit := ChatEdit{
+		ID:       primitive.NewObjectID(),
+		Chat:     chat.ID,
+		Message:  chat.Message,
+		EditedAt: now,
+	}
+	edits := s.db.Collection("chat_edits")
+	if _, err := edits.InsertOne(ctx, edit); err != nil {
+		return chout, err
+	}
+
+	// only replace the version we read so concurrent edits don't lose history
+	filter := bson.M{"_id": chat.ID, "message": chat.Message, "deleted_at": bson.M{"$exists": false}}
+	update := bson.M{
+		"$set": bson.M{
+			"message":          message,
+			"edited_at":        now,
+			"updated_at":       now,
+			"mentions":         mentioned,
+			"mention_entities": mentions,
+		},
+		// the links may have changed, they're unfurled again below
+		"$unset": bson.M{"previews": ""},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var edited Chat
+	err = s.db.Collection("chats").FindOneAndUpdate(ctx, filter, update, opts).Decode(&edited)
+	if err != nil {
+		// the edit didn't happen, neither did its history
+		edits.DeleteOne(ctx, bson.M{"_id": edit.ID})
+		if err == mongo.ErrNoDocuments {
+			return chout, ErrChatChanged
+		}
+		return chout, err
+	}
+
+	chout, err = s.chatOutput(edited)
+	if err != nil {
+		return chout, err
+	}
+
+	s.events.Broadcast(chout.Room, "message_edited", chout)
+	s.notifyMentions(chout, newMentions(chat.Mentions, mentioned))
+	s.unfurlChat(edited)
+
+	return chout, nil
+}
+
+// GetChatEdits lists the previous versions of a chat, oldest first.
+func (s *Service) GetChatEdits(ctx context.Context, chatID primitive.ObjectID) ([]ChatEdit, error) {
+	edits := []ChatEdit{}
+
+	chat, err := s.findChat(chatID)
+	if err != nil {
+		return edits, err
+	}
+	if chat.DeletedAt != nil {
+		return edits, ErrChatDeleted
+	}
+
+	uid, _ := s.AuthUserID(ctx)
+	if err := s.checkRoomAccess(chat.Room, uid); err != nil {
+		return edits, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.M{"edited_at": 1})
+	cur, err := s.db.Collection("chat_edits").Find(ctx, bson.M{"chat": chatID}, opts)
+	if err != nil {
+		return edits, err
+	}
+	defer cur.Close(ctx)
+
+	err = cur.All(ctx, &edits)
+
+	return edits, err
+}
+
+func (s *Service) findChat(id primitive.ObjectID) (Chat, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	chat := Chat{}
+	err := s.db.Collection("chats").FindOne(ctx, bson.M{"_id": id}).Decode(&chat)
+	if err == mongo.ErrNoDocuments {
+		return chat, ErrChatNotFound
+	}
+
+	return chat, err
+}
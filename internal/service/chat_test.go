@@ -0,0 +1,43 @@
+package service
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSameClientChat(t *testing.T) {
+	room := primitive.NewObjectID()
+	parent := primitive.NewObjectID()
+	sameParent := parent
+	otherParent := primitive.NewObjectID()
+	original := Chat{Room: room, ClientMsgID: "c1"}
+	reply := Chat{Room: room, ParentID: &parent, ClientMsgID: "c1"}
+
+	tests := []struct {
+		name     string
+		original Chat
+		resent   Chat
+		wantErr  bool
+	}{
+		{"same room", original, Chat{Room: room, ClientMsgID: "c1"}, false},
+		{"other room", original, Chat{Room: primitive.NewObjectID(), ClientMsgID: "c1"}, true},
+		{"lobby", original, Chat{ClientMsgID: "c1"}, true},
+		{"same lobby", Chat{ClientMsgID: "c1"}, Chat{ClientMsgID: "c1"}, false},
+		{"same thread", reply, Chat{Room: room, ParentID: &sameParent, ClientMsgID: "c1"}, false},
+		{"other thread", reply, Chat{Room: room, ParentID: &otherParent, ClientMsgID: "c1"}, true},
+		{"thread to room", reply, Chat{Room: room, ClientMsgID: "c1"}, true},
+		{"room to thread", original, reply, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sameClientChat(tt.original, tt.resent)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sameClientChat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if verr, ok := err.(*ValidationError); tt.wantErr && (!ok || verr.Code != "duplicate") {
+				t.Errorf("sameClientChat() error = %#v, want a duplicate ValidationError", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// commandRunTTL is how long a resent command is recognized.
+const commandRunTTL = 24 * time.Hour
+
+// ErrCommandRunning used when a command is resent while it still runs.
+var ErrCommandRunning = errors.New("command is still running")
+
+// CommandRun records a slash command sent with a client message ID, so
+// resending it answers like the first time instead of running it again.
+type CommandRun struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Sender      primitive.ObjectID `bson:"sender" json:"sender"`
+	ClientMsgID string             `bson:"client_msg_id" json:"client_msg_id"`
+	Command     string             `bson:"command" json:"command"`
+	// Reply and Message are what the command answered, once it finished.
+	Reply      string     `bson:"reply,omitempty" json:"reply,omitempty"`
+	Message    string     `bson:"message,omitempty" json:"message,omitempty"`
+	FinishedAt *time.Time `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	ExpiresAt  time.Time  `bson:"expires_at" json:"-"`
+}
+
+// StartCommandRun claims the run of a command. When the sender already ran
+// it, it returns that run and true instead, or ErrCommandRunning if the
+// run didn't finish.
+func (s *Service) StartCommandRun(sender primitive.ObjectID, clientMsgID, name string) (CommandRun, bool, error) {
+	now := time.Now()
+	run := CommandRun{
+		ID:          primitive.NewObjectID(),
+		Sender:      sender,
+		ClientMsgID: clientMsgID,
+		Command:     name,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(commandRunTTL),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	runs := s.db.Collection("command_runs")
+	_, err := runs.InsertOne(ctx, run)
+	if !isDuplicateKeyError(err) {
+		return run, false, err
+	}
+
+	err = runs.FindOne(ctx, bson.M{"sender": sender, "client_msg_id": clientMsgID}).Decode(&run)
+	if err == mongo.ErrNoDocuments {
+		// it failed and was dropped in the meantime, let the client retry
+		return run, false, ErrCommandRunning
+	}
+	if err != nil {
+		return run, false, err
+	}
+	if run.FinishedAt == nil {
+		return run, false, ErrCommandRunning
+	}
+
+	return run, true, nil
+}
+
+// FinishCommandRun records what the command answered.
+func (s *Service) FinishCommandRun(run CommandRun, reply, message string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	set := bson.M{"reply": reply, "message": message, "finished_at": time.Now()}
+	_, err := s.db.Collection("command_runs").UpdateOne(ctx, bson.M{"_id": run.ID}, bson.M{"$set": set})
+
+	return err
+}
+
+// DropCommandRun forgets a run that failed, so it can be sent again.
+func (s *Service) DropCommandRun(run CommandRun) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.db.Collection("command_runs").DeleteOne(ctx, bson.M{"_id": run.ID})
+
+	return err
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// maxMessageTTL is the longest a self-destructing message can live.
+	maxMessageTTL = 30 * 24 * 60 * 60
+	// expiryGrace is how long after expiring the TTL index drops a chat the
+	// expirer didn't get to, without cleaning up after it.
+	expiryGrace = time.Hour
+)
+
+// ErrInvalidMessageTTL used when the message lifetime is negative or too long.
+var ErrInvalidMessageTTL = errors.New("invalid message ttl")
+
+// expiredChat is sent to the clients in place of an expired chat.
+type expiredChat struct {
+	ID       primitive.ObjectID  `json:"id"`
+	Room     primitive.ObjectID  `json:"room,omitempty"`
+	ParentID *primitive.ObjectID `json:"parent_id,omitempty"`
+}
+
+func validMessageTTL(ttl int64) bool {
+	return ttl >= 0 && ttl <= maxMessageTTL
+}
+
+// notExpired filters out the chats that expired but weren't removed yet.
+func notExpired() bson.M {
+	return bson.M{"$not": bson.M{"$lte": time.Now()}}
+}
+
+// setExpiry works out when the chat expires from its own TTL or else the
+// default of its room.
+func (s *Service) setExpiry(c *Chat) error {
+	ttl := c.TTL
+	if ttl == 0 && !c.Room.IsZero() {
+		room, err := s.findRoom(c.Room)
+		if err != nil {
+			return err
+		}
+		ttl = room.MessageTTL
+	}
+	if ttl == 0 {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(time.Duration(ttl) * time.Second)
+	c.ExpiresAt = &expiresAt
+
+	return nil
+}
+
+// RunExpirer removes the expired chats every interval until ctx is done.
+// Each chat is taken with an atomic delete, so several instances can run it.
+func (s *Service) RunExpirer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			chat, ok, err := s.takeExpiredChat()
+			if err != nil {
+				log.Printf("could not remove expired messages: %v", err)
+				break
+			}
+			if !ok {
+				break
+			}
+			s.expireChat(chat)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) takeExpiredChat() (Chat, bool, error) {
+	var chat Chat
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.db.Collection("chats").FindOneAndDelete(ctx, bson.M{"expires_at": bson.M{"$lte": time.Now()}}).Decode(&chat)
+	if err == mongo.ErrNoDocuments {
+		return chat, false, nil
+	}
+	if err != nil {
+		return chat, false, err
+	}
+
+	return chat, true, nil
+}
+
+// expireChat cleans up after a removed chat and tells the clients to drop it.
+func (s *Service) expireChat(chat Chat) {
+	s.removeOrphanAttachments(chat)
+
+	if unpinned, err := s.removePin(chat.Room, chat.ID); err != nil {
+		log.Printf("could not unpin expired chat %s: %v", chat.ID.Hex(), err)
+	} else if unpinned {
+		s.events.Broadcast(chat.Room, "message_unpinned", Pin{Room: chat.Room, Chat: chat.ID, PinnedAt: time.Now()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, name := range []string{"reactions", "poll_votes", "chat_edits"} {
+		if _, err := s.db.Collection(name).DeleteMany(ctx, bson.M{"chat": chat.ID}); err != nil {
+			log.Printf("could not remove %s of expired chat %s: %v", name, chat.ID.Hex(), err)
+		}
+	}
+
+	out := expiredChat{ID: chat.ID, Room: chat.Room, ParentID: chat.ParentID}
+	if chat.ParentID != nil {
+		s.events.BroadcastThread(*chat.ParentID, "message_expired", out)
+	}
+	s.events.Broadcast(chat.Room, "message_expired", out)
+}
@@ -0,0 +1,536 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Export formats.
+const (
+	ExportJSONL = "jsonl"
+	ExportCSV   = "csv"
+	ExportHTML  = "html"
+)
+
+// Statuses of an export job.
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+)
+
+// ExportPath is the directory where finished exports are stored.
+const ExportPath = "./exports"
+
+const (
+	exportLease     = 10 * time.Minute
+	exportBatchSize = 500
+)
+
+var (
+	// ErrInvalidExport used when the export format or date range is invalid.
+	ErrInvalidExport = errors.New("invalid export")
+	// ErrExportNotFound used when the export wasn't found on the db.
+	ErrExportNotFound = errors.New("export not found")
+	// ErrExportNotReady used when downloading an export that didn't finish.
+	ErrExportNotReady = errors.New("export is not ready")
+)
+
+// ExportJob is a request to export the history of a room. It runs in the
+// background, see RunExporter.
+type ExportJob struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Room        primitive.ObjectID `bson:"room" json:"room"`
+	RequestedBy primitive.ObjectID `bson:"requested_by" json:"requested_by"`
+	Format      string             `bson:"format" json:"format"`
+	From        time.Time          `bson:"from" json:"from"`
+	To          time.Time          `bson:"to" json:"to"`
+	Status      string             `bson:"status" json:"status"`
+	Chats       int                `bson:"chats" json:"chats"`
+	Error       string             `bson:"error,omitempty" json:"error,omitempty"`
+	LockedUntil time.Time          `bson:"locked_until" json:"-"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	FinishedAt  *time.Time         `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	// DownloadURL is where the finished export can be downloaded.
+	DownloadURL string `bson:"-" json:"download_url,omitempty"`
+}
+
+// ExportRoom queues an export of the room history between from and to for
+// a room owner or moderator. A zero to means up to now.
+func (s *Service) ExportRoom(ctx context.Context, roomID primitive.ObjectID, format string, from, to time.Time) (ExportJob, error) {
+	var job ExportJob
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return job, err
+	}
+	if _, err := s.findRoom(roomID); err != nil {
+		return job, err
+	}
+	if !s.isRoomModerator(roomID, uid) {
+		return job, ErrNotRoomModerator
+	}
+
+	if format != ExportJSONL && format != ExportCSV && format != ExportHTML {
+		return job, ErrInvalidExport
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if !from.Before(to) {
+		return job, ErrInvalidExport
+	}
+
+	job = ExportJob{
+		ID:          primitive.NewObjectID(),
+		Room:        roomID,
+		RequestedBy: uid,
+		Format:      format,
+		From:        from,
+		To:          to,
+		Status:      ExportPending,
+		CreatedAt:   time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = s.db.Collection("export_jobs").InsertOne(ctx, job)
+
+	return job, err
+}
+
+// GetExport retrieves an export job of the authenticated user.
+func (s *Service) GetExport(ctx context.Context, id primitive.ObjectID) (ExportJob, error) {
+	var job ExportJob
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return job, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.db.Collection("export_jobs").FindOne(ctx, bson.M{"_id": id, "requested_by": uid}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return job, ErrExportNotFound
+	}
+	if err != nil {
+		return job, err
+	}
+	if job.Status == ExportDone {
+		job.DownloadURL = exportURL(job)
+	}
+
+	return job, nil
+}
+
+// ExportFile returns the path and download name of a finished export of the
+// authenticated user.
+func (s *Service) ExportFile(ctx context.Context, id primitive.ObjectID) (string, string, error) {
+	job, err := s.GetExport(ctx, id)
+	if err != nil {
+		return "", "", err
+	}
+	if job.Status != ExportDone {
+		return "", "", ErrExportNotReady
+	}
+
+	name := "room-" + job.Room.Hex() + "-" + job.From.Format("20060102") + "-" + job.To.Format("20060102") + "." + job.Format
+
+	return exportFilePath(job), name, nil
+}
+
+// RunExporter runs the queued exports every interval until ctx is done. Jobs
+// are claimed with a lease, so several instances can run it and a job whose
+// instance died is picked up again.
+func (s *Service) RunExporter(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			job, ok, err := s.claimExport()
+			if err != nil {
+				log.Printf("could not claim exports: %v", err)
+				break
+			}
+			if !ok {
+				break
+			}
+			s.runExport(job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) claimExport() (ExportJob, bool, error) {
+	var job ExportJob
+
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": ExportPending},
+		bson.M{"status": ExportRunning, "locked_until": bson.M{"$lt": now}},
+	}}
+	update := bson.M{"$set": bson.M{"status": ExportRunning, "locked_until": now.Add(exportLease)}}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"created_at": 1}).SetReturnDocument(options.After)
+	err := s.db.Collection("export_jobs").FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return job, false, nil
+	}
+	if err != nil {
+		return job, false, err
+	}
+
+	return job, true, nil
+}
+
+func (s *Service) runExport(job ExportJob) {
+	err := s.writeExport(&job)
+
+	now := time.Now()
+	set := bson.M{"chats": job.Chats, "finished_at": now}
+	if err != nil {
+		log.Printf("could not export room %s: %v", job.Room.Hex(), err)
+		job.Status, job.Error = ExportFailed, err.Error()
+		set["error"] = job.Error
+	} else {
+		job.Status = ExportDone
+		job.DownloadURL = exportURL(job)
+	}
+	set["status"] = job.Status
+	job.FinishedAt = &now
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Collection("export_jobs").UpdateOne(ctx, bson.M{"_id": job.ID}, bson.M{"$set": set}); err != nil {
+		log.Printf("could not update export %s: %v", job.ID.Hex(), err)
+		return
+	}
+
+	s.events.Notify(job.RequestedBy, "export_finished", job)
+}
+
+// writeExport writes the job to a file of its own and only moves it in
+// place once complete, so a run that lost its lease can't clobber the file
+// of the run that took over.
+func (s *Service) writeExport(job *ExportJob) error {
+	if err := os.MkdirAll(ExportPath, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(ExportPath, job.ID.Hex()+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	err = s.encodeExport(job, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), exportFilePath(*job))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// encodeExport streams the chats of the job to w in batches.
+func (s *Service) encodeExport(job *ExportJob, f io.Writer) error {
+	room, err := s.findRoom(job.Room)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+
+	var enc exportEncoder
+	switch job.Format {
+	case ExportJSONL:
+		enc = &jsonlEncoder{w: w}
+	case ExportCSV:
+		enc = &csvEncoder{w: csv.NewWriter(w), baseURL: s.config.PublicURL}
+	default:
+		enc = &htmlEncoder{w: w, baseURL: s.config.PublicURL, avatars: make(map[string]template.URL)}
+	}
+	if err := enc.begin(room, *job); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportLease)
+	defer cancel()
+	filter := bson.M{
+		"room":       job.Room,
+		"created_at": bson.M{"$gte": job.From, "$lt": job.To},
+		"expires_at": notExpired(),
+	}
+	opts := options.Find().SetSort(historyOrder()).SetBatchSize(exportBatchSize)
+	cur, err := s.db.Collection("chats").Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	batch := make([]Chat, 0, exportBatchSize)
+	flush := func() error {
+		outs, err := s.chatOutputs(primitive.NilObjectID, batch)
+		if err != nil {
+			return err
+		}
+		for _, out := range outs {
+			if err := enc.encode(out); err != nil {
+				return err
+			}
+		}
+		job.Chats += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for cur.Next(ctx) {
+		var chat Chat
+		if err := cur.Decode(&chat); err != nil {
+			return err
+		}
+		batch = append(batch, chat)
+		if len(batch) == exportBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if err := enc.end(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func exportFilePath(job ExportJob) string {
+	return filepath.Join(ExportPath, job.ID.Hex()+"."+job.Format)
+}
+
+func exportURL(job ExportJob) string {
+	return "/api/exports/" + job.ID.Hex() + "/download"
+}
+
+type exportEncoder interface {
+	begin(room Room, job ExportJob) error
+	encode(out chatOutput) error
+	end() error
+}
+
+// jsonlEncoder writes a chatOutput per line.
+type jsonlEncoder struct {
+	w io.Writer
+}
+
+func (e *jsonlEncoder) begin(Room, ExportJob) error { return nil }
+func (e *jsonlEncoder) end() error                  { return nil }
+
+func (e *jsonlEncoder) encode(out chatOutput) error {
+	return json.NewEncoder(e.w).Encode(out)
+}
+
+type csvEncoder struct {
+	w       *csv.Writer
+	baseURL string
+}
+
+func (e *csvEncoder) begin(Room, ExportJob) error {
+	return e.w.Write([]string{"id", "seq", "created_at", "sender_id", "sender", "type", "parent_id", "message", "attachments", "edited_at", "deleted"})
+}
+
+func (e *csvEncoder) encode(out chatOutput) error {
+	var parent, edited string
+	if out.ParentID != nil {
+		parent = out.ParentID.Hex()
+	}
+	if out.EditedAt != nil {
+		edited = out.EditedAt.Format(time.RFC3339)
+	}
+
+	return e.w.Write([]string{
+		out.ID.Hex(),
+		strconv.FormatInt(out.Seq, 10),
+		out.CreatedAt.Format(time.RFC3339),
+		out.Sender.ID.Hex(),
+		csvCell(displayName(out.Sender)),
+		out.Type,
+		parent,
+		csvCell(out.Message),
+		strings.Join(attachmentLinks(e.baseURL, out), " "),
+		edited,
+		strconv.FormatBool(out.DeletedAt != nil),
+	})
+}
+
+func (e *csvEncoder) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// csvCell keeps spreadsheets from running text typed by users as a formula.
+func csvCell(v string) string {
+	if v != "" && strings.ContainsAny(v[:1], "=+-@\t\r") {
+		return "'" + v
+	}
+	return v
+}
+
+// htmlEncoder writes a transcript that opens without the server: avatars
+// are embedded and attachments link to the absolute file URL.
+type htmlEncoder struct {
+	w       io.Writer
+	baseURL string
+	avatars map[string]template.URL
+}
+
+var exportTemplate = template.Must(template.New("export").Parse(`
+{{define "begin"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Room.Name}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 2em auto; color: #222; }
+.chat { display: flex; gap: .75em; margin: 1em 0; }
+.chat.reply { margin-left: 3em; }
+.avatar { width: 36px; height: 36px; border-radius: 50%; background: #ccc; flex: none; }
+.meta { color: #777; font-size: .85em; }
+.system, .deleted { color: #777; font-style: italic; }
+pre { background: #f4f4f4; padding: .5em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>{{.Room.Name}}</h1>
+<p class="meta">{{.Job.From.Format "2006-01-02 15:04"}} to {{.Job.To.Format "2006-01-02 15:04"}}</p>
+{{end}}
+{{define "chat"}}<div class="chat{{if .Chat.ParentID}} reply{{end}}" id="{{.Chat.ID.Hex}}">
+{{if .Avatar}}<img class="avatar" src="{{.Avatar}}" alt="">{{else}}<div class="avatar"></div>{{end}}
+<div>
+<div><strong>{{.Name}}</strong> <span class="meta">{{.Chat.CreatedAt.Format "2006-01-02 15:04:05"}}{{if .Chat.EditedAt}} (edited){{end}}</span></div>
+{{if .Chat.DeletedAt}}<div class="deleted">message deleted</div>
+{{else if .System}}<div class="system">{{.System}}</div>
+{{else}}<div>{{.HTML}}</div>
+{{range .Attachments}}<div><a href="{{.}}">{{.}}</a></div>{{end}}
+{{end}}</div>
+</div>
+{{end}}
+{{define "end"}}</body>
+</html>
+{{end}}`))
+
+func (e *htmlEncoder) begin(room Room, job ExportJob) error {
+	return exportTemplate.ExecuteTemplate(e.w, "begin", struct {
+		Room Room
+		Job  ExportJob
+	}{room, job})
+}
+
+func (e *htmlEncoder) encode(out chatOutput) error {
+	var system string
+	if out.Payload != nil && out.Payload.System != nil {
+		system = out.Payload.System.Event
+	}
+
+	return exportTemplate.ExecuteTemplate(e.w, "chat", struct {
+		Chat        chatOutput
+		Name        string
+		Avatar      template.URL
+		HTML        template.HTML
+		System      string
+		Attachments []string
+	}{
+		Chat:   out,
+		Name:   displayName(out.Sender),
+		Avatar: e.avatar(out.Sender),
+		// already sanitized by the markdown renderer
+		HTML:        template.HTML(out.HTML),
+		System:      system,
+		Attachments: attachmentLinks(e.baseURL, out),
+	})
+}
+
+func (e *htmlEncoder) end() error {
+	return exportTemplate.ExecuteTemplate(e.w, "end", nil)
+}
+
+// avatar embeds an uploaded avatar as a data URL. Avatars hosted elsewhere
+// aren't fetched.
+func (e *htmlEncoder) avatar(u UserChat) template.URL {
+	if u.AvatarURL == nil {
+		return ""
+	}
+	if data, ok := e.avatars[*u.AvatarURL]; ok {
+		return data
+	}
+
+	var data template.URL
+	if m := uploadRef.FindStringSubmatch(*u.AvatarURL); m != nil {
+		contentType := mime.TypeByExtension(filepath.Ext(m[1]))
+		if b, err := ioutil.ReadFile(filepath.Join(UploadPath, m[1])); err == nil && strings.HasPrefix(contentType, "image/") {
+			data = template.URL("data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(b))
+		}
+	}
+	e.avatars[*u.AvatarURL] = data
+
+	return data
+}
+
+func displayName(u UserChat) string {
+	name := strings.TrimSpace(u.Name + " " + u.Lastname)
+	if name == "" {
+		return u.Username
+	}
+	return name
+}
+
+// attachmentLinks lists the absolute URLs of the uploads of a chat.
+func attachmentLinks(baseURL string, out chatOutput) []string {
+	if out.DeletedAt != nil {
+		return nil
+	}
+
+	chat := Chat{Message: out.Message, Payload: out.Payload}
+	var links []string
+	for _, name := range attachments(chat) {
+		links = append(links, strings.TrimSuffix(baseURL, "/")+"/files/"+name)
+	}
+
+	return links
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"html/template"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func exportChats() []chatOutput {
+	created := time.Date(2020, 5, 1, 10, 30, 0, 0, time.UTC)
+	edited := created.Add(time.Minute)
+	parent, _ := primitive.ObjectIDFromHex("5ea3f0c2e1b2a3c4d5e6f701")
+	sender := UserChat{ID: primitive.NewObjectID(), Username: "ana", Name: "Ana", Lastname: "<Lima>"}
+
+	return []chatOutput{
+		{
+			ID:        primitive.NewObjectID(),
+			Sender:    sender,
+			Message:   "see files/0a1b.png",
+			HTML:      "<p>see files/0a1b.png</p>",
+			Type:      KindText,
+			Seq:       1,
+			CreatedAt: created,
+			EditedAt:  &edited,
+		},
+		{
+			ID:        primitive.NewObjectID(),
+			ParentID:  &parent,
+			Sender:    UserChat{ID: primitive.NewObjectID(), Username: "bob"},
+			Message:   "=HYPERLINK(\"https://evil.example\")",
+			Type:      KindFile,
+			Payload:   &Payload{File: "files/ff00.pdf"},
+			Seq:       2,
+			CreatedAt: created,
+		},
+		{
+			ID:        primitive.NewObjectID(),
+			Sender:    sender,
+			Type:      KindSystem,
+			Payload:   &Payload{System: &SystemEvent{Event: EventMemberJoined}},
+			Seq:       3,
+			CreatedAt: created,
+		},
+		{
+			ID:        primitive.NewObjectID(),
+			Sender:    sender,
+			Type:      KindText,
+			Seq:       4,
+			CreatedAt: created,
+			DeletedAt: &created,
+		},
+	}
+}
+
+func encodeAll(t *testing.T, enc exportEncoder) {
+	t.Helper()
+	room := Room{Name: "General & more"}
+	job := ExportJob{From: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2020, 5, 2, 0, 0, 0, 0, time.UTC)}
+
+	if err := enc.begin(room, job); err != nil {
+		t.Fatalf("begin() error = %v", err)
+	}
+	for _, out := range exportChats() {
+		if err := enc.encode(out); err != nil {
+			t.Fatalf("encode() error = %v", err)
+		}
+	}
+	if err := enc.end(); err != nil {
+		t.Fatalf("end() error = %v", err)
+	}
+}
+
+func TestJSONLEncoder(t *testing.T) {
+	var b bytes.Buffer
+	encodeAll(t, &jsonlEncoder{w: &b})
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	chats := exportChats()
+	if len(lines) != len(chats) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(chats))
+	}
+	for i, line := range lines {
+		var got struct {
+			Seq     int64  `json:"seq"`
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if got.Seq != chats[i].Seq || got.Type != chats[i].Type || got.Message != chats[i].Message {
+			t.Errorf("line %d = %+v, want seq %d type %s message %q", i, got, chats[i].Seq, chats[i].Type, chats[i].Message)
+		}
+	}
+}
+
+func TestCSVEncoder(t *testing.T) {
+	var b bytes.Buffer
+	encodeAll(t, &csvEncoder{w: csv.NewWriter(&b), baseURL: "https://chat.example.com/"})
+
+	records, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("got %d records, want a header and 4 chats", len(records))
+	}
+	if records[0][0] != "id" || len(records[0]) != 11 {
+		t.Errorf("header = %v", records[0])
+	}
+
+	tests := []struct {
+		name   string
+		record []string
+		column int
+		want   string
+	}{
+		{"seq", records[1], 1, "1"},
+		{"created at", records[1], 2, "2020-05-01T10:30:00Z"},
+		{"full name", records[1], 4, "Ana <Lima>"},
+		{"username fallback", records[2], 4, "bob"},
+		{"parent", records[2], 6, "5ea3f0c2e1b2a3c4d5e6f701"},
+		{"message", records[1], 7, "see files/0a1b.png"},
+		{"formula", records[2], 7, `'=HYPERLINK("https://evil.example")`},
+		{"message attachment", records[1], 8, "https://chat.example.com/files/0a1b.png"},
+		{"payload attachment", records[2], 8, "https://chat.example.com/files/ff00.pdf"},
+		{"edited", records[1], 9, "2020-05-01T10:31:00Z"},
+		{"not edited", records[2], 9, ""},
+		{"not deleted", records[1], 10, "false"},
+		{"deleted", records[4], 10, "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.record[tt.column]; got != tt.want {
+				t.Errorf("column %d = %q, want %q", tt.column, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTMLEncoder(t *testing.T) {
+	var b bytes.Buffer
+	encodeAll(t, &htmlEncoder{w: &b, baseURL: "https://chat.example.com", avatars: make(map[string]template.URL)})
+	page := b.String()
+
+	tests := []struct {
+		name string
+		want string
+		not  bool
+	}{
+		{name: "escaped title", want: "<title>General &amp; more</title>"},
+		{name: "escaped sender", want: "<strong>Ana &lt;Lima&gt;</strong>"},
+		{name: "rendered message", want: "<div><p>see files/0a1b.png</p></div>"},
+		{name: "edited", want: "(edited)"},
+		{name: "reply", want: `class="chat reply"`},
+		{name: "attachment", want: `<a href="https://chat.example.com/files/ff00.pdf">`},
+		{name: "system event", want: `<div class="system">` + EventMemberJoined + `</div>`},
+		{name: "tombstone", want: `<div class="deleted">message deleted</div>`},
+		{name: "closed", want: "</html>"},
+		{name: "no raw sender", want: "<Lima>", not: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if strings.Contains(page, tt.want) == tt.not {
+				t.Errorf("page contains %q = %v, want %v", tt.want, !tt.not, !tt.not)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Kinds of messages, stored in Chat.Type.
+const (
+	KindText   = "text"
+	KindImage  = "image"
+	KindVideo  = "video"
+	KindAudio  = "audio"
+	KindFile   = "file"
+	KindSystem = "system"
+	KindPoll   = "poll"
+)
+
+const (
+	maxMessageLength  = 4000
+	maxClientMsgID    = 64
+	maxPollOptions    = 10
+	maxPollTextLength = 300
+)
+
+// mediaKinds maps the kinds that carry an upload to the content type prefix
+// the upload must have.
+var mediaKinds = map[string]string{
+	KindImage: "image/",
+	KindVideo: "video/",
+	KindAudio: "audio/",
+	KindFile:  "",
+}
+
+// Payload holds the kind specific content of a message.
+type Payload struct {
+	// File is the "files/..." path of the upload of media messages. The
+	// content type and size are filled in from the upload.
+	File        string `bson:"file,omitempty" json:"file,omitempty"`
+	ContentType string `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	Size        int64  `bson:"size,omitempty" json:"size,omitempty"`
+	// Question and Options describe a poll. Multiple lets voters pick more
+	// than one option, Anonymous hides who voted what, and no votes are
+	// taken after ClosesAt.
+	Question  string     `bson:"question,omitempty" json:"question,omitempty"`
+	Options   []string   `bson:"options,omitempty" json:"options,omitempty"`
+	Multiple  bool       `bson:"multiple,omitempty" json:"multiple,omitempty"`
+	Anonymous bool       `bson:"anonymous,omitempty" json:"anonymous,omitempty"`
+	ClosesAt  *time.Time `bson:"closes_at,omitempty" json:"closes_at,omitempty"`
+	// System describes the room event of a system message.
+	System *SystemEvent `bson:"system,omitempty" json:"system,omitempty"`
+}
+
+// ValidationError tells why a message was rejected. Code is meant for
+// clients to switch on, Message for people to read.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+func invalid(field, code, message string) *ValidationError {
+	return &ValidationError{Field: field, Code: code, Message: message}
+}
+
+// validateChat checks the message against the schema of its kind and
+// normalizes its payload. Messages without a type are text.
+func (s *Service) validateChat(c *Chat) error {
+	if c.Type == "" {
+		c.Type = KindText
+	}
+
+	if utf8.RuneCountInString(c.Message) > maxMessageLength {
+		return invalid("message", "too_long", "message is too long")
+	}
+	if len(c.ClientMsgID) > maxClientMsgID {
+		return invalid("client_msg_id", "too_long", "client message id is too long")
+	}
+	if !validMessageTTL(c.TTL) {
+		return invalid("ttl", "invalid", "ttl must be between 0 and 30 days")
+	}
+
+	switch c.Type {
+	case KindText:
+		if strings.TrimSpace(c.Message) == "" {
+			return invalid("message", "required", "text messages need a message")
+		}
+		if c.Payload != nil {
+			return invalid("payload", "unexpected", "text messages have no payload")
+		}
+
+	case KindImage, KindVideo, KindAudio, KindFile:
+		return s.validateMedia(c)
+
+	case KindPoll:
+		return validatePoll(c)
+
+	case KindSystem:
+		return invalid("type", "forbidden", "system messages are sent by the server only")
+
+	default:
+		return invalid("type", "unsupported", "unsupported message type")
+	}
+
+	return nil
+}
+
+// validateMedia checks that the message references an upload of the sender
+// with a content type matching its kind.
+func (s *Service) validateMedia(c *Chat) error {
+	if c.Payload == nil || c.Payload.File == "" {
+		return invalid("payload.file", "required", c.Type+" messages need an uploaded file")
+	}
+
+	m := uploadRef.FindStringSubmatch(c.Payload.File)
+	if m == nil || m[0] != c.Payload.File {
+		return invalid("payload.file", "invalid", "file must be the path returned by the upload")
+	}
+
+	upload, err := s.findUpload(m[1])
+	if err == ErrUploadNotFound {
+		return invalid("payload.file", "not_found", "file was not uploaded")
+	}
+	if err != nil {
+		return err
+	}
+	if upload.Owner != c.Sender {
+		return invalid("payload.file", "forbidden", "file was uploaded by someone else")
+	}
+	if !strings.HasPrefix(upload.ContentType, mediaKinds[c.Type]) {
+		return invalid("payload.file", "wrong_type", "file doesn't match the "+c.Type+" type")
+	}
+
+	c.Payload = &Payload{
+		File:        c.Payload.File,
+		ContentType: upload.ContentType,
+		Size:        upload.Size,
+	}
+
+	return nil
+}
+
+func validatePoll(c *Chat) error {
+	if c.Payload == nil || strings.TrimSpace(c.Payload.Question) == "" {
+		return invalid("payload.question", "required", "polls need a question")
+	}
+	question := strings.TrimSpace(c.Payload.Question)
+	if utf8.RuneCountInString(question) > maxPollTextLength {
+		return invalid("payload.question", "too_long", "question is too long")
+	}
+
+	if len(c.Payload.Options) < 2 || len(c.Payload.Options) > maxPollOptions {
+		return invalid("payload.options", "invalid", "polls need between 2 and 10 options")
+	}
+	options := make([]string, len(c.Payload.Options))
+	seen := make(map[string]bool)
+	for i, o := range c.Payload.Options {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			return invalid("payload.options", "required", "options cannot be empty")
+		}
+		if utf8.RuneCountInString(o) > maxPollTextLength {
+			return invalid("payload.options", "too_long", "option is too long")
+		}
+		if seen[strings.ToLower(o)] {
+			return invalid("payload.options", "duplicate", "options must be different")
+		}
+		seen[strings.ToLower(o)] = true
+		options[i] = o
+	}
+
+	closesAt := c.Payload.ClosesAt
+	if closesAt != nil && (!closesAt.After(time.Now()) || time.Until(*closesAt) > maxScheduleAhead) {
+		return invalid("payload.closes_at", "invalid", "polls must close in the future and within a year")
+	}
+
+	c.Payload = &Payload{
+		Question:  question,
+		Options:   options,
+		Multiple:  c.Payload.Multiple,
+		Anonymous: c.Payload.Anonymous,
+		ClosesAt:  closesAt,
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatePoll(t *testing.T) {
+	soon := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+	tooFar := time.Now().Add(2 * maxScheduleAhead)
+	options := func(n int) []string {
+		opts := make([]string, n)
+		for i := range opts {
+			opts[i] = strings.Repeat("o", i+1)
+		}
+		return opts
+	}
+
+	tests := []struct {
+		name     string
+		payload  *Payload
+		wantCode string
+		want     *Payload
+	}{
+		{
+			name:    "valid",
+			payload: &Payload{Question: " Lunch? ", Options: []string{" pizza ", "sushi"}, Multiple: true, Anonymous: true, ClosesAt: &soon},
+			want:    &Payload{Question: "Lunch?", Options: []string{"pizza", "sushi"}, Multiple: true, Anonymous: true, ClosesAt: &soon},
+		},
+		{
+			name:    "drops other fields",
+			payload: &Payload{Question: "Q", Options: []string{"a", "b"}, File: "files/ab.png", Size: 10},
+			want:    &Payload{Question: "Q", Options: []string{"a", "b"}},
+		},
+		{name: "no payload", wantCode: "required"},
+		{name: "blank question", payload: &Payload{Question: "  ", Options: []string{"a", "b"}}, wantCode: "required"},
+		{name: "long question", payload: &Payload{Question: strings.Repeat("q", maxPollTextLength+1), Options: []string{"a", "b"}}, wantCode: "too_long"},
+		{name: "one option", payload: &Payload{Question: "Q", Options: []string{"a"}}, wantCode: "invalid"},
+		{name: "too many options", payload: &Payload{Question: "Q", Options: options(maxPollOptions + 1)}, wantCode: "invalid"},
+		{name: "most options", payload: &Payload{Question: "Q", Options: options(maxPollOptions)}, want: &Payload{Question: "Q", Options: options(maxPollOptions)}},
+		{name: "blank option", payload: &Payload{Question: "Q", Options: []string{"a", " "}}, wantCode: "required"},
+		{name: "long option", payload: &Payload{Question: "Q", Options: []string{"a", strings.Repeat("o", maxPollTextLength+1)}}, wantCode: "too_long"},
+		{name: "duplicate option", payload: &Payload{Question: "Q", Options: []string{"Yes", " yes"}}, wantCode: "duplicate"},
+		{name: "closed", payload: &Payload{Question: "Q", Options: []string{"a", "b"}, ClosesAt: &past}, wantCode: "invalid"},
+		{name: "closes too late", payload: &Payload{Question: "Q", Options: []string{"a", "b"}, ClosesAt: &tooFar}, wantCode: "invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Chat{Type: KindPoll, Payload: tt.payload}
+			err := validatePoll(&c)
+			if tt.wantCode != "" {
+				verr, ok := err.(*ValidationError)
+				if !ok || verr.Code != tt.wantCode {
+					t.Fatalf("validatePoll() error = %v, want code %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validatePoll() error = %v", err)
+			}
+
+			got := c.Payload
+			if got.Question != tt.want.Question || strings.Join(got.Options, "|") != strings.Join(tt.want.Options, "|") ||
+				got.Multiple != tt.want.Multiple || got.Anonymous != tt.want.Anonymous || got.ClosesAt != tt.want.ClosesAt ||
+				got.File != "" || got.Size != 0 {
+				t.Errorf("payload = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package service
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// MentionUser mentions a single user by username.
+	MentionUser = "user"
+	// MentionHere mentions the room members that are online.
+	MentionHere = "here"
+	// MentionChannel mentions every room member.
+	MentionChannel = "channel"
+)
+
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@.])(@[A-Za-z0-9_.]{1,32})`)
+
+// Mention is a mention found in a message. Offset and Length count runes.
+type Mention struct {
+	Type   string              `bson:"type" json:"type"`
+	Text   string              `bson:"text" json:"text"`
+	Offset int                 `bson:"offset" json:"offset"`
+	Length int                 `bson:"length" json:"length"`
+	User   *primitive.ObjectID `bson:"user,omitempty" json:"-"`
+}
+
+type mentionOutput struct {
+	Mention
+	User *UserChat `json:"user,omitempty"`
+}
+
+// Notification is a record of something that happened to a user while they
+// may not have been around.
+type Notification struct {
+	ID   primitive.ObjectID `bson:"_id" json:"id"`
+	User primitive.ObjectID `bson:"user" json:"user"`
+	Type string             `bson:"type" json:"type"`
+	Chat primitive.ObjectID `bson:"chat" json:"chat"`
+	Room primitive.ObjectID `bson:"room,omitempty" json:"room,omitempty"`
+	From primitive.ObjectID `bson:"from" json:"from"`
+	// Redacted is set when the user can't read the room, so only where the
+	// chat is and who sent it are shared.
+	Redacted  bool      `bson:"redacted,omitempty" json:"redacted,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+// parseMentions finds the @username, @here and @channel mentions of a message.
+func parseMentions(message string) []Mention {
+	var mentions []Mention
+	for _, m := range mentionPattern.FindAllStringSubmatchIndex(message, -1) {
+		text := strings.TrimRight(message[m[2]:m[3]], ".")
+		if len(text) < 2 {
+			continue
+		}
+		mention := Mention{
+			Text:   text,
+			Offset: utf8.RuneCountInString(message[:m[2]]),
+			Length: utf8.RuneCountInString(text),
+		}
+
+		switch strings.ToLower(text) {
+		case "@here":
+			mention.Type = MentionHere
+		case "@channel":
+			mention.Type = MentionChannel
+		default:
+			mention.Type = MentionUser
+		}
+
+		mentions = append(mentions, mention)
+	}
+
+	return mentions
+}
+
+// resolveMentions parses the mentions of a message sent to the room and
+// resolves them to users, whether they can read the room or not. Unknown
+// usernames are dropped, @here and @channel only mean something in rooms
+// with members.
+func (s *Service) resolveMentions(roomID, sender primitive.ObjectID, message string) ([]Mention, []primitive.ObjectID, error) {
+	var (
+		mentions []Mention
+		users    []primitive.ObjectID
+	)
+
+	seen := make(map[primitive.ObjectID]bool)
+	add := func(uid primitive.ObjectID) {
+		if uid != sender && !seen[uid] {
+			seen[uid] = true
+			users = append(users, uid)
+		}
+	}
+
+	for _, m := range parseMentions(message) {
+		switch m.Type {
+		case MentionUser:
+			u, err := s.findUserByUsername(strings.ToLower(m.Text[1:]))
+			if err != nil {
+				continue
+			}
+			m.User = &u.ID
+			add(u.ID)
+		case MentionHere, MentionChannel:
+			if roomID.IsZero() {
+				continue
+			}
+			members, err := s.roomMemberIDs(roomID)
+			if err != nil {
+				return mentions, users, err
+			}
+			for _, uid := range members {
+				if m.Type == MentionChannel || s.events.Online(uid) {
+					add(uid)
+				}
+			}
+		}
+
+		mentions = append(mentions, m)
+	}
+
+	return mentions, users, nil
+}
+
+// notifyMentions records a notification for each mentioned user and sends
+// them the mentioned event wherever they are connected. Users who can't read
+// the room get both without the message.
+func (s *Service) notifyMentions(chout chatOutput, users []primitive.ObjectID) {
+	muted, err := s.mutedMembers(chout.Room, users)
+	if err != nil {
+		log.Printf("could not check muted members of room %s: %v", chout.Room.Hex(), err)
+	}
+	var notified []primitive.ObjectID
+	for _, uid := range users {
+		if !muted[uid] {
+			notified = append(notified, uid)
+		}
+	}
+	users = notified
+	if len(users) == 0 {
+		return
+	}
+
+	redacted := make(map[primitive.ObjectID]bool)
+	for _, uid := range users {
+		redacted[uid] = s.checkRoomAccess(chout.Room, uid) != nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	docs := make([]interface{}, len(users))
+	for i, uid := range users {
+		docs[i] = Notification{
+			ID:        primitive.NewObjectID(),
+			User:      uid,
+			Type:      "mention",
+			Chat:      chout.ID,
+			Room:      chout.Room,
+			From:      chout.Sender.ID,
+			Redacted:  redacted[uid],
+			CreatedAt: time.Now(),
+		}
+	}
+	if _, err := s.db.Collection("notifications").InsertMany(ctx, docs); err != nil {
+		log.Printf("could not save mention notifications for %s: %v", chout.ID.Hex(), err)
+	}
+
+	outline := chatOutput{
+		ID:        chout.ID,
+		Room:      chout.Room,
+		ParentID:  chout.ParentID,
+		Sender:    chout.Sender,
+		Type:      chout.Type,
+		CreatedAt: chout.CreatedAt,
+		Redacted:  true,
+	}
+	for _, uid := range users {
+		if redacted[uid] {
+			s.events.Notify(uid, "mentioned", outline)
+		} else {
+			s.events.Notify(uid, "mentioned", chout)
+		}
+	}
+}
+
+// newMentions lists the users mentioned now that weren't mentioned before.
+func newMentions(before, after []primitive.ObjectID) []primitive.ObjectID {
+	var added []primitive.ObjectID
+	for _, uid := range after {
+		found := false
+		for _, old := range before {
+			if old == uid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, uid)
+		}
+	}
+
+	return added
+}
+
+// GetNotifications lists the latest notifications of the authenticated user.
+func (s *Service) GetNotifications(ctx context.Context) ([]Notification, error) {
+	notifications := []Notification{}
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return notifications, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(50)
+	cur, err := s.db.Collection("notifications").Find(ctx, bson.M{"user": uid}, opts)
+	if err != nil {
+		return notifications, err
+	}
+	defer cur.Close(ctx)
+
+	err = cur.All(ctx, &notifications)
+
+	return notifications, err
+}
+
+func (s *Service) mentionOutputs(mentions []Mention, users map[primitive.ObjectID]UserChat) ([]mentionOutput, error) {
+	var outs []mentionOutput
+	for _, m := range mentions {
+		out := mentionOutput{Mention: m}
+		if m.User != nil {
+			u, ok := users[*m.User]
+			if !ok {
+				var err error
+				if u, err = s.findUserChatById(*m.User); err != nil {
+					return outs, err
+				}
+				users[*m.User] = u
+			}
+			out.User = &u
+		}
+		outs = append(outs, out)
+	}
+
+	return outs, nil
+}
+
+func (s *Service) roomMemberIDs(roomID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	ids := []primitive.ObjectID{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := s.db.Collection("room_members").Find(ctx, bson.M{"room": roomID})
+	if err != nil {
+		return ids, err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var m RoomMember
+		if err := cur.Decode(&m); err != nil {
+			return ids, err
+		}
+		ids = append(ids, m.User)
+	}
+
+	return ids, cur.Err()
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// PinByMembers lets every room member pin messages.
+	PinByMembers = "members"
+	// PinByModerators lets only the room owner and moderators pin messages.
+	PinByModerators = "moderators"
+)
+
+var (
+	// ErrPinLimit used when the room already has as many pins as allowed.
+	ErrPinLimit = errors.New("room reached the pinned messages limit")
+	// ErrAlreadyPinned used when pinning a message twice.
+	ErrAlreadyPinned = errors.New("message is already pinned")
+	// ErrNotPinned used when unpinning a message that isn't pinned.
+	ErrNotPinned = errors.New("message is not pinned")
+	// ErrInvalidPinPermission used when the pin permission is unknown.
+	ErrInvalidPinPermission = errors.New("invalid pin permission")
+)
+
+type Pin struct {
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	Room     primitive.ObjectID `bson:"room" json:"room"`
+	Chat     primitive.ObjectID `bson:"chat" json:"chat"`
+	PinnedBy primitive.ObjectID `bson:"pinned_by" json:"pinned_by"`
+	PinnedAt time.Time          `bson:"pinned_at" json:"pinned_at"`
+}
+
+type pinOutput struct {
+	Pin
+	Message chatOutput `json:"message"`
+}
+
+func validPinPermission(v string) bool {
+	return v == PinByMembers || v == PinByModerators
+}
+
+// PinChat pins a message of the room for the authenticated user.
+func (s *Service) PinChat(ctx context.Context, roomID, chatID primitive.ObjectID) (pinOutput, error) {
+	var out pinOutput
+
+	uid, chat, err := s.pinTarget(ctx, roomID, chatID)
+	if err != nil {
+		return out, err
+	}
+	if chat.DeletedAt != nil {
+		return out, ErrChatDeleted
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// reserve a slot first so concurrent pins can't go over the limit
+	rooms := s.db.Collection("rooms")
+	filter := bson.M{"_id": roomID, "pin_count": bson.M{"$not": bson.M{"$gte": s.config.MaxPinsPerRoom}}}
+	res, err := rooms.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"pin_count": 1}})
+	if err != nil {
+		return out, err
+	}
+	if res.ModifiedCount == 0 {
+		return out, ErrPinLimit
+	}
+
+	pin := Pin{
+		ID:       primitive.NewObjectID(),
+		Room:     roomID,
+		Chat:     chat.ID,
+		PinnedBy: uid,
+		PinnedAt: time.Now(),
+	}
+	if _, err := s.db.Collection("pins").InsertOne(ctx, pin); err != nil {
+		rooms.UpdateOne(ctx, bson.M{"_id": roomID}, bson.M{"$inc": bson.M{"pin_count": -1}})
+		if isDuplicateKeyError(err) {
+			return out, ErrAlreadyPinned
+		}
+		return out, err
+	}
+
+	out.Pin = pin
+	if out.Message, err = s.chatOutput(chat); err != nil {
+		return out, err
+	}
+
+	s.events.Broadcast(roomID, "message_pinned", out)
+
+	return out, nil
+}
+
+// UnpinChat unpins a message of the room for the authenticated user.
+func (s *Service) UnpinChat(ctx context.Context, roomID, chatID primitive.ObjectID) error {
+	uid, chat, err := s.pinTarget(ctx, roomID, chatID)
+	if err != nil {
+		return err
+	}
+
+	removed, err := s.removePin(roomID, chat.ID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return ErrNotPinned
+	}
+
+	s.events.Broadcast(roomID, "message_unpinned", Pin{Room: roomID, Chat: chat.ID, PinnedBy: uid, PinnedAt: time.Now()})
+
+	return nil
+}
+
+// GetPins lists the pinned messages of a room, latest first.
+func (s *Service) GetPins(ctx context.Context, roomID primitive.ObjectID) ([]pinOutput, error) {
+	outs := []pinOutput{}
+
+	uid, _ := s.AuthUserID(ctx)
+	if err := s.checkRoomAccess(roomID, uid); err != nil {
+		return outs, err
+	}
+	if roomID.IsZero() {
+		return outs, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.M{"pinned_at": -1})
+	cur, err := s.db.Collection("pins").Find(ctx, bson.M{"room": roomID}, opts)
+	if err != nil {
+		return outs, err
+	}
+	var pins []Pin
+	if err := cur.All(ctx, &pins); err != nil {
+		return outs, err
+	}
+
+	for _, pin := range pins {
+		chat, err := s.findChat(pin.Chat)
+		if err == ErrChatNotFound {
+			// the message is gone for good, give its slot back
+			if _, err := s.removePin(roomID, pin.Chat); err != nil {
+				log.Printf("could not release pin of %s: %v", pin.Chat.Hex(), err)
+			}
+			continue
+		}
+		if err != nil {
+			return outs, err
+		}
+		chats, err := s.chatOutputs(uid, []Chat{chat})
+		if err != nil {
+			return outs, err
+		}
+		outs = append(outs, pinOutput{pin, chats[0]})
+	}
+
+	return outs, nil
+}
+
+// pinTarget checks that the authenticated user may change the pins of the
+// room and that the chat belongs to it.
+func (s *Service) pinTarget(ctx context.Context, roomID, chatID primitive.ObjectID) (primitive.ObjectID, Chat, error) {
+	var chat Chat
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return uid, chat, err
+	}
+
+	room, err := s.findRoom(roomID)
+	if err != nil {
+		return uid, chat, err
+	}
+	if _, err := s.findRoomMember(roomID, uid); err != nil {
+		return uid, chat, err
+	}
+	if room.PinPermission == PinByModerators && !s.isRoomModerator(roomID, uid) {
+		return uid, chat, ErrNotRoomModerator
+	}
+
+	chat, err = s.findChat(chatID)
+	if err != nil {
+		return uid, chat, err
+	}
+	if chat.Room != roomID {
+		return uid, chat, ErrChatNotFound
+	}
+
+	return uid, chat, nil
+}
+
+// removePin drops the pin of a chat, if any, giving its slot back to the room.
+func (s *Service) removePin(roomID, chatID primitive.ObjectID) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := s.db.Collection("pins").DeleteOne(ctx, bson.M{"room": roomID, "chat": chatID})
+	if err != nil {
+		return false, err
+	}
+	if res.DeletedCount == 0 {
+		return false, nil
+	}
+
+	if _, err := s.db.Collection("rooms").UpdateOne(ctx, bson.M{"_id": roomID}, bson.M{"$inc": bson.M{"pin_count": -1}}); err != nil {
+		log.Printf("could not release pin slot of room %s: %v", roomID.Hex(), err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrNotPoll used when voting on a message that isn't a poll.
+	ErrNotPoll = errors.New("message is not a poll")
+	// ErrPollClosed used when voting on a poll after it closed.
+	ErrPollClosed = errors.New("poll is closed")
+	// ErrInvalidOption used when voting for an option the poll doesn't have.
+	ErrInvalidOption = errors.New("invalid poll option")
+)
+
+// PollVote is the vote of a user for an option of a poll. Single choice
+// votes are flagged so the db keeps one per user.
+type PollVote struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Chat      primitive.ObjectID `bson:"chat" json:"chat"`
+	User      primitive.ObjectID `bson:"user" json:"user"`
+	Option    int                `bson:"option" json:"option"`
+	Single    bool               `bson:"single,omitempty" json:"-"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// pollOption is the tally of an option. Voters are only listed on public polls.
+type pollOption struct {
+	Count  int        `json:"count"`
+	Voters []UserChat `json:"voters,omitempty"`
+}
+
+type pollOutput struct {
+	Options []pollOption `json:"options"`
+	// Voters is how many people voted, which differs from the sum of the
+	// counts on multiple choice polls.
+	Voters  int   `json:"voters"`
+	MyVotes []int `json:"my_votes,omitempty"`
+	Closed  bool  `json:"closed"`
+}
+
+// PollUpdate is broadcast when someone votes or takes a vote back. User is
+// left out on anonymous polls.
+type PollUpdate struct {
+	Chat primitive.ObjectID  `json:"chat"`
+	Room primitive.ObjectID  `json:"room,omitempty"`
+	User *primitive.ObjectID `json:"user,omitempty"`
+	Poll pollOutput          `json:"poll"`
+}
+
+// Vote votes for an option of a poll as the authenticated user. On single
+// choice polls it replaces the earlier vote of the user.
+func (s *Service) Vote(ctx context.Context, chatID primitive.ObjectID, option int) (PollUpdate, error) {
+	return s.setVote(ctx, chatID, option, true)
+}
+
+// Unvote takes back the vote of the authenticated user for an option of a poll.
+func (s *Service) Unvote(ctx context.Context, chatID primitive.ObjectID, option int) (PollUpdate, error) {
+	return s.setVote(ctx, chatID, option, false)
+}
+
+func (s *Service) setVote(ctx context.Context, chatID primitive.ObjectID, option int, voted bool) (PollUpdate, error) {
+	var update PollUpdate
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return update, err
+	}
+
+	chat, err := s.findChat(chatID)
+	if err != nil {
+		return update, err
+	}
+	if chat.DeletedAt != nil {
+		return update, ErrChatDeleted
+	}
+	if chat.Type != KindPoll || chat.Payload == nil {
+		return update, ErrNotPoll
+	}
+	if err := s.checkRoomAccess(chat.Room, uid); err != nil {
+		return update, err
+	}
+	if pollClosed(chat.Payload) {
+		return update, ErrPollClosed
+	}
+	if option < 0 || option >= len(chat.Payload.Options) {
+		return update, ErrInvalidOption
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	votes := s.db.Collection("poll_votes")
+	key := bson.M{"chat": chat.ID, "user": uid, "option": option}
+
+	switch {
+	case voted && chat.Payload.Multiple:
+		set := bson.M{"$setOnInsert": bson.M{"_id": primitive.NewObjectID(), "created_at": time.Now()}}
+		_, err = votes.UpdateOne(ctx, key, set, options.Update().SetUpsert(true))
+	case voted:
+		// the upsert moves the single vote of the user to the option
+		set := bson.M{
+			"$set":         bson.M{"option": option, "created_at": time.Now()},
+			"$setOnInsert": bson.M{"_id": primitive.NewObjectID(), "single": true},
+		}
+		_, err = votes.UpdateOne(ctx, bson.M{"chat": chat.ID, "user": uid}, set, options.Update().SetUpsert(true))
+	default:
+		_, err = votes.DeleteOne(ctx, key)
+	}
+	if isDuplicateKeyError(err) {
+		// a concurrent vote of the same user got in first
+		err = nil
+	}
+	if err != nil {
+		return update, err
+	}
+
+	s.touchChat(chat.ID)
+
+	polls, err := s.pollsFor([]Chat{chat}, primitive.NilObjectID)
+	if err != nil {
+		return update, err
+	}
+
+	update = PollUpdate{Chat: chat.ID, Room: chat.Room, Poll: *polls[chat.ID]}
+	if !chat.Payload.Anonymous {
+		update.User = &uid
+	}
+
+	s.events.Broadcast(update.Room, "poll_updated", update)
+
+	// the voter gets their own votes back
+	if update.Poll.MyVotes, err = s.myVotes(chat.ID, uid); err != nil {
+		return update, err
+	}
+
+	return update, nil
+}
+
+// pollsFor tallies the votes of the polls among the chats, with the votes of
+// the viewer.
+func (s *Service) pollsFor(chats []Chat, viewer primitive.ObjectID) (map[primitive.ObjectID]*pollOutput, error) {
+	out := make(map[primitive.ObjectID]*pollOutput)
+
+	var ids []primitive.ObjectID
+	polls := make(map[primitive.ObjectID]*Payload)
+	for _, chat := range chats {
+		if chat.Type != KindPoll || chat.Payload == nil {
+			continue
+		}
+		ids = append(ids, chat.ID)
+		polls[chat.ID] = chat.Payload
+		out[chat.ID] = &pollOutput{
+			Options: make([]pollOption, len(chat.Payload.Options)),
+			Closed:  pollClosed(chat.Payload),
+		}
+	}
+	if len(ids) == 0 {
+		return out, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.M{"created_at": 1})
+	cur, err := s.db.Collection("poll_votes").Find(ctx, bson.M{"chat": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return out, err
+	}
+	defer cur.Close(ctx)
+
+	voters := make(map[primitive.ObjectID]map[primitive.ObjectID]bool)
+	users := make(map[primitive.ObjectID]UserChat)
+	for cur.Next(ctx) {
+		var v PollVote
+		if err := cur.Decode(&v); err != nil {
+			return out, err
+		}
+		poll := out[v.Chat]
+		if v.Option < 0 || v.Option >= len(poll.Options) {
+			continue
+		}
+
+		if voters[v.Chat] == nil {
+			voters[v.Chat] = make(map[primitive.ObjectID]bool)
+		}
+		if !voters[v.Chat][v.User] {
+			voters[v.Chat][v.User] = true
+			poll.Voters++
+		}
+
+		option := &poll.Options[v.Option]
+		option.Count++
+		if v.User == viewer {
+			poll.MyVotes = append(poll.MyVotes, v.Option)
+		}
+		if !polls[v.Chat].Anonymous {
+			u, ok := users[v.User]
+			if !ok {
+				if u, err = s.findUserChatById(v.User); err != nil {
+					return out, err
+				}
+				users[v.User] = u
+			}
+			option.Voters = append(option.Voters, u)
+		}
+	}
+
+	return out, cur.Err()
+}
+
+func (s *Service) myVotes(chatID, uid primitive.ObjectID) ([]int, error) {
+	var mine []int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := s.db.Collection("poll_votes").Find(ctx, bson.M{"chat": chatID, "user": uid})
+	if err != nil {
+		return mine, err
+	}
+	var votes []PollVote
+	if err := cur.All(ctx, &votes); err != nil {
+		return mine, err
+	}
+	for _, v := range votes {
+		mine = append(mine, v.Option)
+	}
+
+	return mine, nil
+}
+
+func pollClosed(p *Payload) bool {
+	return p.ClosesAt != nil && !p.ClosesAt.After(time.Now())
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/leogsouza/api-suchat/internal/markdown"
+	"github.com/leogsouza/api-suchat/internal/unfurl"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxPreviews is how many links of a message get a preview.
+const maxPreviews = 3
+
+// Unfurler fetches the preview of a link.
+type Unfurler interface {
+	Fetch(ctx context.Context, url string) (unfurl.Preview, error)
+}
+
+// linkPreview is a cached preview. Failed fetches are cached too so a broken
+// link isn't fetched again for every message that shares it.
+type linkPreview struct {
+	URL       string         `bson:"_id"`
+	Preview   unfurl.Preview `bson:"preview"`
+	Failed    bool           `bson:"failed,omitempty"`
+	FetchedAt time.Time      `bson:"fetched_at"`
+	// ExpiresAt is when the db drops the preview, so the cache TTL can
+	// change without touching the index.
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// unfurlChat fetches the previews of the links of a chat in the background
+// and, once they're attached, sends the updated chat as "message_updated".
+func (s *Service) unfurlChat(chat Chat) {
+	if s.config.Unfurler == nil || chat.DeletedAt != nil {
+		return
+	}
+
+	urls := linkURLs(markdown.Parse(chat.Message))
+	if len(urls) == 0 {
+		return
+	}
+
+	go func() {
+		var previews []unfurl.Preview
+		for _, u := range urls {
+			preview, ok := s.linkPreview(u)
+			if ok {
+				previews = append(previews, preview)
+			}
+		}
+		if len(previews) == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// the message may have been edited or deleted in the meantime
+		filter := bson.M{"_id": chat.ID, "message": chat.Message, "deleted_at": bson.M{"$exists": false}}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		var updated Chat
+		err := s.db.Collection("chats").FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"previews": previews, "updated_at": time.Now()}}, opts).Decode(&updated)
+		if err == mongo.ErrNoDocuments {
+			return
+		}
+		if err != nil {
+			log.Printf("could not attach previews to %s: %v", chat.ID.Hex(), err)
+			return
+		}
+
+		out, err := s.chatOutput(updated)
+		if err != nil {
+			log.Printf("could not load chat %s: %v", chat.ID.Hex(), err)
+			return
+		}
+
+		if out.ParentID != nil {
+			s.events.BroadcastThread(*out.ParentID, "message_updated", out)
+		} else {
+			s.events.Broadcast(out.Room, "message_updated", out)
+		}
+	}()
+}
+
+// linkPreview returns the preview of the link from the cache, fetching it
+// when it isn't there yet.
+func (s *Service) linkPreview(url string) (unfurl.Preview, bool) {
+	previews := s.db.Collection("link_previews")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	var cached linkPreview
+	err := previews.FindOne(ctx, bson.M{"_id": url, "expires_at": bson.M{"$gt": time.Now()}}).Decode(&cached)
+	cancel()
+	if err == nil {
+		return cached.Preview, !cached.Failed
+	}
+	if err != mongo.ErrNoDocuments {
+		log.Printf("could not read preview of %s: %v", url, err)
+	}
+
+	preview, err := s.config.Unfurler.Fetch(context.Background(), url)
+	now := time.Now()
+	cached = linkPreview{
+		URL:       url,
+		Preview:   preview,
+		Failed:    err != nil || preview.Empty(),
+		FetchedAt: now,
+		ExpiresAt: now.Add(s.config.PreviewCacheTTL),
+	}
+	if err != nil {
+		log.Printf("could not unfurl %s: %v", url, err)
+	}
+
+	// the fetch may take as long as the timeout, so the write gets its own
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.Replace().SetUpsert(true)
+	if _, err := previews.ReplaceOne(ctx, bson.M{"_id": url}, cached, opts); err != nil {
+		log.Printf("could not cache preview of %s: %v", url, err)
+	}
+
+	return cached.Preview, !cached.Failed
+}
+
+// linkURLs collects the distinct web links of a message, in order.
+func linkURLs(n *markdown.Node) []string {
+	var urls []string
+	seen := make(map[string]bool)
+
+	var walk func(*markdown.Node)
+	walk = func(n *markdown.Node) {
+		if len(urls) == maxPreviews {
+			return
+		}
+		if n.Type == markdown.Link && !seen[n.URL] &&
+			(strings.HasPrefix(n.URL, "http://") || strings.HasPrefix(n.URL, "https://")) {
+			seen[n.URL] = true
+			urls = append(urls, n.URL)
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(n)
+
+	return urls
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxEmojiLen = 64
+
+// ErrInvalidEmoji used when the reaction is not a single emoji or shortcode.
+var ErrInvalidEmoji = errors.New("invalid emoji")
+
+type Reaction struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Chat      primitive.ObjectID `bson:"chat" json:"chat"`
+	User      primitive.ObjectID `bson:"user" json:"user"`
+	Emoji     string             `bson:"emoji" json:"emoji"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+type reactionOutput struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reacted_by_me"`
+}
+
+// ReactionUpdate is broadcast when someone adds or removes a reaction.
+type ReactionUpdate struct {
+	Chat    primitive.ObjectID `json:"chat"`
+	Room    primitive.ObjectID `json:"room,omitempty"`
+	User    primitive.ObjectID `json:"user"`
+	Emoji   string             `json:"emoji"`
+	Count   int64              `json:"count"`
+	Reacted bool               `json:"reacted"`
+}
+
+// validEmoji reports whether the reaction is a single emoji. Skin tones,
+// variation selectors, keycaps, flags and sequences joined with ZWJ count as
+// one emoji.
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLen || !utf8.ValidString(emoji) {
+		return false
+	}
+
+	clusters, regional := 0, 0
+	joined, needKeycap := false, false
+	for _, r := range emoji {
+		switch {
+		case r == '\u200d':
+			if clusters == 0 || joined {
+				return false
+			}
+			joined = true
+			continue
+		case r == '\ufe0e' || r == '\ufe0f' || r >= 0x1f3fb && r <= 0x1f3ff || r >= 0xe0020 && r <= 0xe007f:
+			// variation selectors, skin tones and the tags of subdivision flags
+			if clusters == 0 || joined {
+				return false
+			}
+		case r == '\u20e3':
+			if !needKeycap {
+				return false
+			}
+			needKeycap = false
+		case r >= '0' && r <= '9' || r == '#' || r == '*':
+			if clusters > 0 {
+				return false
+			}
+			clusters++
+			needKeycap = true
+		case r >= 0x1f1e6 && r <= 0x1f1ff:
+			// flags are pairs of regional indicators
+			if regional == 1 && !joined {
+				regional = 2
+			} else {
+				clusters++
+				regional = 1
+			}
+		case unicode.Is(unicode.So, r):
+			if !joined {
+				clusters++
+			}
+			regional = 0
+		default:
+			return false
+		}
+		joined = false
+	}
+
+	return clusters == 1 && regional != 1 && !joined && !needKeycap
+}
+
+// AddReaction reacts to a chat as the authenticated user. Reacting twice with
+// the same emoji has no effect.
+func (s *Service) AddReaction(ctx context.Context, chatID primitive.ObjectID, emoji string) (ReactionUpdate, error) {
+	return s.setReaction(ctx, chatID, emoji, true)
+}
+
+// RemoveReaction removes the authenticated user's reaction from a chat.
+func (s *Service) RemoveReaction(ctx context.Context, chatID primitive.ObjectID, emoji string) (ReactionUpdate, error) {
+	return s.setReaction(ctx, chatID, emoji, false)
+}
+
+func (s *Service) setReaction(ctx context.Context, chatID primitive.ObjectID, emoji string, reacted bool) (ReactionUpdate, error) {
+	var update ReactionUpdate
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return update, err
+	}
+
+	if !validEmoji(emoji) {
+		return update, ErrInvalidEmoji
+	}
+
+	chat, err := s.findChat(chatID)
+	if err != nil {
+		return update, err
+	}
+	if chat.DeletedAt != nil {
+		return update, ErrChatDeleted
+	}
+	if err := s.checkRoomAccess(chat.Room, uid); err != nil {
+		return update, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reactions := s.db.Collection("reactions")
+	key := bson.M{"chat": chat.ID, "user": uid, "emoji": emoji}
+
+	if reacted {
+		// upsert keeps a single reaction per user and emoji
+		set := bson.M{"$setOnInsert": bson.M{"_id": primitive.NewObjectID(), "created_at": time.Now()}}
+		_, err = reactions.UpdateOne(ctx, key, set, options.Update().SetUpsert(true))
+		if isDuplicateKeyError(err) {
+			err = nil
+		}
+	} else {
+		_, err = reactions.DeleteOne(ctx, key)
+	}
+	if err != nil {
+		return update, err
+	}
+
+	count, err := reactions.CountDocuments(ctx, bson.M{"chat": chat.ID, "emoji": emoji})
+	if err != nil {
+		return update, err
+	}
+
+	s.touchChat(chat.ID)
+
+	update = ReactionUpdate{
+		Chat:    chat.ID,
+		Room:    chat.Room,
+		User:    uid,
+		Emoji:   emoji,
+		Count:   count,
+		Reacted: reacted,
+	}
+
+	s.events.Broadcast(update.Room, "reaction_updated", update)
+
+	return update, nil
+}
+
+// reactionsFor aggregates the reactions of the chats, in the order each emoji
+// was first used, flagging the ones added by the viewer.
+func (s *Service) reactionsFor(chatIDs []primitive.ObjectID, viewer primitive.ObjectID) (map[primitive.ObjectID][]reactionOutput, error) {
+	out := make(map[primitive.ObjectID][]reactionOutput)
+	if len(chatIDs) == 0 {
+		return out, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.M{"created_at": 1})
+	cur, err := s.db.Collection("reactions").Find(ctx, bson.M{"chat": bson.M{"$in": chatIDs}}, opts)
+	if err != nil {
+		return out, err
+	}
+	defer cur.Close(ctx)
+
+	index := make(map[primitive.ObjectID]map[string]int)
+	for cur.Next(ctx) {
+		var r Reaction
+		if err := cur.Decode(&r); err != nil {
+			return out, err
+		}
+
+		if _, ok := index[r.Chat]; !ok {
+			index[r.Chat] = make(map[string]int)
+		}
+		i, ok := index[r.Chat][r.Emoji]
+		if !ok {
+			i = len(out[r.Chat])
+			index[r.Chat][r.Emoji] = i
+			out[r.Chat] = append(out[r.Chat], reactionOutput{Emoji: r.Emoji})
+		}
+
+		out[r.Chat][i].Count++
+		if !viewer.IsZero() && r.User == viewer {
+			out[r.Chat][i].ReactedByMe = true
+		}
+	}
+
+	return out, cur.Err()
+}
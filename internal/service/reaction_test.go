@@ -0,0 +1,47 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		name  string
+		emoji string
+		want  bool
+	}{
+		{"simple", "👍", true},
+		{"symbol", "⭐", true},
+		{"variation selector", "❤️", true},
+		{"skin tone", "👍🏽", true},
+		{"zwj sequence", "👩\u200d💻", true},
+		{"family", "👨\u200d👩\u200d👧", true},
+		{"flag", "🇧🇷", true},
+		{"subdivision flag", "🏴\U000E0067\U000E0062\U000E0065\U000E006E\U000E0067\U000E007F", true},
+		{"keycap", "1️⃣", true},
+		{"empty", "", false},
+		{"text", "hello", false},
+		{"shortcode", ":thumbsup:", false},
+		{"digit", "1", false},
+		{"two emoji", "👍👍", false},
+		{"two flags", "🇧🇷🇵🇹", false},
+		{"lone regional indicator", "🇧", false},
+		{"emoji and text", "👍x", false},
+		{"space", "👍 ", false},
+		{"markup", "<b>", false},
+		{"leading modifier", "🏽", false},
+		{"leading zwj", "\u200d👍", false},
+		{"trailing zwj", "👍\u200d", false},
+		{"invalid utf-8", "\xf0\x9f", false},
+		{"too long", strings.Repeat("👩\u200d", 20) + "💻", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validEmoji(tt.emoji); got != tt.want {
+				t.Errorf("validEmoji(%q) = %v, want %v", tt.emoji, got, tt.want)
+			}
+		})
+	}
+}
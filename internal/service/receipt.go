@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReadState is the last message a user has read in a room. It is broadcast as
+// the read receipt whenever it moves forward.
+type ReadState struct {
+	ID       primitive.ObjectID `bson:"_id" json:"-"`
+	Room     primitive.ObjectID `bson:"room" json:"room"`
+	User     primitive.ObjectID `bson:"user" json:"user"`
+	LastRead primitive.ObjectID `bson:"last_read" json:"last_read"`
+	// LastReadSeq is the seq of the last read chat. States that only reached
+	// chats from before sequence numbers existed don't have it.
+	LastReadSeq int64     `bson:"last_read_seq,omitempty" json:"last_read_seq,omitempty"`
+	ReadAt      time.Time `bson:"read_at" json:"read_at"`
+}
+
+type conversationOutput struct {
+	Room         Room                `json:"room"`
+	LastRead     *primitive.ObjectID `json:"last_read,omitempty"`
+	UnreadCount  int64               `json:"unread_count"`
+	MentionCount int64               `json:"mention_count"`
+}
+
+// MarkRead moves the authenticated user's read pointer in the room up to the
+// chat. Marking an older chat as read leaves the pointer where it is.
+func (s *Service) MarkRead(ctx context.Context, roomID, chatID primitive.ObjectID) (ReadState, error) {
+	var state ReadState
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return state, err
+	}
+
+	if _, err := s.findRoomMember(roomID, uid); err != nil {
+		return state, err
+	}
+
+	chat, err := s.findChat(chatID)
+	if err != nil {
+		return state, err
+	}
+	if chat.Room != roomID {
+		return state, ErrChatNotFound
+	}
+
+	state, advanced, err := s.markRead(roomID, uid, chat.ID, chat.Seq)
+	if err != nil {
+		return state, err
+	}
+	if advanced {
+		s.events.Broadcast(roomID, "read_receipt", state)
+	}
+
+	return state, nil
+}
+
+// markRead advances the read pointer to the chat with the given seq and
+// reports whether it moved. Chats without seq are compared by ID, and only
+// against states that didn't read a chat with seq yet.
+func (s *Service) markRead(roomID, userID, chatID primitive.ObjectID, seq int64) (ReadState, bool, error) {
+	var state ReadState
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	states := s.db.Collection("read_states")
+	filter := bson.M{"room": roomID, "user": userID}
+	set := bson.M{"last_read": chatID, "read_at": time.Now()}
+	if seq > 0 {
+		filter["$or"] = bson.A{
+			bson.M{"last_read_seq": bson.M{"$exists": false}},
+			bson.M{"last_read_seq": bson.M{"$lt": seq}},
+		}
+		set["last_read_seq"] = seq
+	} else {
+		filter["$or"] = bson.A{
+			bson.M{"last_read": bson.M{"$exists": false}},
+			bson.M{"last_read_seq": bson.M{"$exists": false}, "last_read": bson.M{"$lt": chatID}},
+		}
+	}
+	update := bson.M{
+		"$set":         set,
+		"$setOnInsert": bson.M{"_id": primitive.NewObjectID()},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := states.FindOneAndUpdate(ctx, filter, update, opts).Decode(&state)
+	if isDuplicateKeyError(err) {
+		// the user already read past this chat
+		err = states.FindOne(ctx, bson.M{"room": roomID, "user": userID}).Decode(&state)
+		return state, false, err
+	}
+
+	return state, err == nil, err
+}
+
+// GetConversations lists the rooms of the authenticated user with how many
+// messages, and mentions of the user, they haven't read yet.
+func (s *Service) GetConversations(ctx context.Context) ([]conversationOutput, error) {
+	convs := []conversationOutput{}
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return convs, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := s.db.Collection("room_members").Find(ctx, bson.M{"user": uid})
+	if err != nil {
+		return convs, err
+	}
+	var members []RoomMember
+	if err := cur.All(ctx, &members); err != nil {
+		return convs, err
+	}
+
+	for _, m := range members {
+		room, err := s.findRoom(m.Room)
+		if err != nil {
+			return convs, err
+		}
+
+		conv := conversationOutput{Room: room}
+
+		filter := bson.M{
+			"room":       m.Room,
+			"sender":     bson.M{"$ne": uid},
+			"deleted_at": bson.M{"$exists": false},
+			"parent_id":  bson.M{"$exists": false},
+			"expires_at": notExpired(),
+		}
+
+		var state ReadState
+		err = s.db.Collection("read_states").FindOne(ctx, bson.M{"room": m.Room, "user": uid}).Decode(&state)
+		switch {
+		case err == nil && state.LastReadSeq > 0:
+			conv.LastRead = &state.LastRead
+			filter["seq"] = bson.M{"$gt": state.LastReadSeq}
+		case err == nil:
+			// only chats from before seq were read, every chat with seq is newer
+			conv.LastRead = &state.LastRead
+			filter["$or"] = bson.A{
+				bson.M{"seq": bson.M{"$exists": true}},
+				bson.M{"_id": bson.M{"$gt": state.LastRead}},
+			}
+		default:
+			// nothing sent before joining counts as unread
+			filter["_id"] = bson.M{"$gt": primitive.NewObjectIDFromTimestamp(m.JoinedAt)}
+		}
+
+		if conv.UnreadCount, err = s.db.Collection("chats").CountDocuments(ctx, filter); err != nil {
+			return convs, err
+		}
+
+		delete(filter, "parent_id")
+		filter["mentions"] = uid
+		if conv.MentionCount, err = s.db.Collection("chats").CountDocuments(ctx, filter); err != nil {
+			return convs, err
+		}
+
+		convs = append(convs, conv)
+	}
+
+	return convs, nil
+}
+
+// GetSeenBy lists the users, other than the sender, that have read the chat.
+func (s *Service) GetSeenBy(ctx context.Context, chatID primitive.ObjectID) ([]UserChat, error) {
+	users := []UserChat{}
+
+	uid, _ := s.AuthUserID(ctx)
+
+	chat, err := s.findChat(chatID)
+	if err != nil {
+		return users, err
+	}
+	if chat.Room.IsZero() {
+		return users, nil
+	}
+	if err := s.checkRoomAccess(chat.Room, uid); err != nil {
+		return users, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{
+		"room": chat.Room,
+		"user": bson.M{"$ne": chat.Sender},
+	}
+	if chat.Seq > 0 {
+		filter["last_read_seq"] = bson.M{"$gte": chat.Seq}
+	} else {
+		// a chat without seq was seen by anyone that read a chat with one
+		filter["$or"] = bson.A{
+			bson.M{"last_read_seq": bson.M{"$exists": true}},
+			bson.M{"last_read": bson.M{"$gte": chat.ID}},
+		}
+	}
+	cur, err := s.db.Collection("read_states").Find(ctx, filter)
+	if err != nil {
+		return users, err
+	}
+	var states []ReadState
+	if err := cur.All(ctx, &states); err != nil {
+		return users, err
+	}
+
+	for _, state := range states {
+		u, err := s.findUserChatById(state.User)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+
+	return users, nil
+}
@@ -0,0 +1,369 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// RetentionDelete drops the chats older than the retention period.
+	RetentionDelete = "delete"
+	// RetentionArchive moves them to the archive instead.
+	RetentionArchive = "archive"
+
+	maxRetentionDays = 3650
+)
+
+// ArchivePath is the directory where the uploads of archived chats are moved.
+const ArchivePath = "./archive"
+
+var (
+	// ErrInvalidRetention used when the retention policy is unknown or out of range.
+	ErrInvalidRetention = errors.New("invalid retention policy")
+	// ErrNotAdmin used when an action requires a server admin.
+	ErrNotAdmin = errors.New("only admins can do that")
+)
+
+// PurgeRun reports what a purge of a room did, or would do on a dry run.
+type PurgeRun struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Room        primitive.ObjectID `bson:"room" json:"room"`
+	Action      string             `bson:"action" json:"action"`
+	DryRun      bool               `bson:"dry_run" json:"dry_run"`
+	Cutoff      time.Time          `bson:"cutoff" json:"cutoff"`
+	Batches     int                `bson:"batches" json:"batches"`
+	Chats       int64              `bson:"chats" json:"chats"`
+	Attachments int64              `bson:"attachments" json:"attachments"`
+	Error       string             `bson:"error,omitempty" json:"error,omitempty"`
+	StartedAt   time.Time          `bson:"started_at" json:"started_at"`
+	FinishedAt  time.Time          `bson:"finished_at" json:"finished_at"`
+}
+
+// retentionOutput is the retention policy of a room with its last purge.
+type retentionOutput struct {
+	Days    int       `json:"days"`
+	Action  string    `json:"action"`
+	LastRun *PurgeRun `json:"last_run,omitempty"`
+}
+
+// RetentionSettings changes the retention policy of a room. Nil fields are
+// left as they are.
+type RetentionSettings struct {
+	Days   *int
+	Action *string
+}
+
+func validRetention(days int, action string) bool {
+	return days >= 0 && days <= maxRetentionDays &&
+		(action == RetentionDelete || action == RetentionArchive)
+}
+
+// GetRetention shows the retention policy of a room and its last purge to
+// an admin.
+func (s *Service) GetRetention(ctx context.Context, roomID primitive.ObjectID) (retentionOutput, error) {
+	var out retentionOutput
+
+	if !s.isAdmin(ctx) {
+		return out, ErrNotAdmin
+	}
+	room, err := s.findRoom(roomID)
+	if err != nil {
+		return out, err
+	}
+	out.Days, out.Action = room.RetentionDays, retentionAction(room)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var run PurgeRun
+	opts := options.FindOne().SetSort(bson.M{"started_at": -1})
+	err = s.db.Collection("purge_runs").FindOne(ctx, bson.M{"room": roomID}, opts).Decode(&run)
+	if err == nil {
+		out.LastRun = &run
+	} else if err != mongo.ErrNoDocuments {
+		return out, err
+	}
+
+	return out, nil
+}
+
+// UpdateRetention changes the retention policy of a room. Only admins may
+// do it, since it removes history for everyone.
+func (s *Service) UpdateRetention(ctx context.Context, roomID primitive.ObjectID, settings RetentionSettings) (retentionOutput, error) {
+	if !s.isAdmin(ctx) {
+		return retentionOutput{}, ErrNotAdmin
+	}
+	room, err := s.findRoom(roomID)
+	if err != nil {
+		return retentionOutput{}, err
+	}
+
+	days, action := room.RetentionDays, retentionAction(room)
+	if settings.Days != nil {
+		days = *settings.Days
+	}
+	if settings.Action != nil {
+		action = *settings.Action
+	}
+	if !validRetention(days, action) {
+		return retentionOutput{}, ErrInvalidRetention
+	}
+
+	dbctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	set := bson.M{"retention_days": days, "retention_action": action, "updated_at": time.Now()}
+	if _, err := s.db.Collection("rooms").UpdateOne(dbctx, bson.M{"_id": roomID}, bson.M{"$set": set}); err != nil {
+		return retentionOutput{}, err
+	}
+
+	return s.GetRetention(ctx, roomID)
+}
+
+// PurgeRoom applies the retention policy of a room right away for an admin.
+// A dry run only counts what would go.
+func (s *Service) PurgeRoom(ctx context.Context, roomID primitive.ObjectID, dryRun bool) (PurgeRun, error) {
+	if !s.isAdmin(ctx) {
+		return PurgeRun{}, ErrNotAdmin
+	}
+	room, err := s.findRoom(roomID)
+	if err != nil {
+		return PurgeRun{}, err
+	}
+
+	return s.purgeRoom(room, dryRun)
+}
+
+// RunPurger applies the retention policies of every room, and of the lobby
+// when configured, every interval until ctx is done. With dryRun set nothing is removed, the runs are only
+// recorded.
+func (s *Service) RunPurger(ctx context.Context, interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.purgeRooms(dryRun)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) purgeRooms(dryRun bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := s.db.Collection("rooms").Find(ctx, bson.M{"retention_days": bson.M{"$gt": 0}})
+	if err != nil {
+		log.Printf("could not list rooms to purge: %v", err)
+		return
+	}
+	var rooms []Room
+	if err := cur.All(ctx, &rooms); err != nil {
+		log.Printf("could not list rooms to purge: %v", err)
+		return
+	}
+
+	// the lobby isn't stored, its policy comes from the config
+	lobby := Room{RetentionDays: s.config.LobbyRetentionDays, RetentionAction: s.config.LobbyRetentionAction}
+	if lobby.RetentionDays > 0 {
+		if validRetention(lobby.RetentionDays, retentionAction(lobby)) {
+			rooms = append(rooms, lobby)
+		} else {
+			log.Printf("could not purge the lobby: %v", ErrInvalidRetention)
+		}
+	}
+
+	for _, room := range rooms {
+		if _, err := s.purgeRoom(room, dryRun); err != nil {
+			log.Printf("could not purge room %s: %v", room.ID.Hex(), err)
+		}
+	}
+}
+
+// purgeRoom removes the chats of the room older than its retention period in
+// batches, recording the run. Batches are idempotent, so a run interrupted
+// halfway or racing another instance is simply finished by the next one.
+func (s *Service) purgeRoom(room Room, dryRun bool) (PurgeRun, error) {
+	run := PurgeRun{
+		ID:        primitive.NewObjectID(),
+		Room:      room.ID,
+		Action:    retentionAction(room),
+		DryRun:    dryRun,
+		StartedAt: time.Now(),
+	}
+	if room.RetentionDays == 0 {
+		return run, nil
+	}
+	run.Cutoff = run.StartedAt.AddDate(0, 0, -room.RetentionDays)
+
+	// the ObjectID is generated by the server, unlike created_at
+	filter := bson.M{"room": room.ID, "_id": bson.M{"$lt": primitive.NewObjectIDFromTimestamp(run.Cutoff)}}
+	if room.ID.IsZero() {
+		filter["room"] = bson.M{"$exists": false}
+	}
+
+	var err error
+	if dryRun {
+		err = s.countPurge(filter, &run)
+	} else {
+		err = s.purgeBatches(room, filter, &run)
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	run.FinishedAt = time.Now()
+
+	log.Printf("purge of room %s (%s, dry run %t): %d chats, %d attachments in %d batches",
+		room.ID.Hex(), run.Action, run.DryRun, run.Chats, run.Attachments, run.Batches)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Collection("purge_runs").InsertOne(ctx, run); err != nil {
+		log.Printf("could not record purge of room %s: %v", room.ID.Hex(), err)
+	}
+
+	return run, err
+}
+
+func (s *Service) countPurge(filter bson.M, run *PurgeRun) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cur, err := s.db.Collection("chats").Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var chat Chat
+		if err := cur.Decode(&chat); err != nil {
+			return err
+		}
+		run.Chats++
+		run.Attachments += int64(len(attachments(chat)))
+	}
+
+	return cur.Err()
+}
+
+func (s *Service) purgeBatches(room Room, filter bson.M, run *PurgeRun) error {
+	chats := s.db.Collection("chats")
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(s.config.PurgeBatchSize))
+		cur, err := chats.Find(ctx, filter, opts)
+		if err != nil {
+			cancel()
+			return err
+		}
+		var batch []Chat
+		err = cur.All(ctx, &batch)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := s.purgeBatch(room, batch, run); err != nil {
+			return err
+		}
+		run.Batches++
+	}
+}
+
+func (s *Service) purgeBatch(room Room, batch []Chat, run *PurgeRun) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	ids := make([]primitive.ObjectID, len(batch))
+	docs := make([]interface{}, len(batch))
+	for i, chat := range batch {
+		ids[i] = chat.ID
+		docs[i] = chat
+	}
+
+	if retentionAction(room) == RetentionArchive {
+		// unordered so chats archived by an earlier attempt don't stop the rest
+		_, err := s.db.Collection("chats_archive").InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		if err != nil && !isDuplicateKeyError(err) {
+			return err
+		}
+	}
+
+	res, err := s.db.Collection("chats").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	run.Chats += res.DeletedCount
+
+	for _, name := range []string{"reactions", "poll_votes", "chat_edits"} {
+		if _, err := s.db.Collection(name).DeleteMany(ctx, bson.M{"chat": bson.M{"$in": ids}}); err != nil {
+			return err
+		}
+	}
+	pins, err := s.db.Collection("pins").DeleteMany(ctx, bson.M{"chat": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	if pins.DeletedCount > 0 {
+		s.db.Collection("rooms").UpdateOne(ctx, bson.M{"_id": room.ID}, bson.M{"$inc": bson.M{"pin_count": -pins.DeletedCount}})
+	}
+
+	for _, chat := range batch {
+		if retentionAction(room) == RetentionArchive {
+			run.Attachments += int64(len(s.archiveOrphanAttachments(chat)))
+		} else {
+			run.Attachments += int64(len(s.removeOrphanAttachments(chat)))
+		}
+	}
+
+	return nil
+}
+
+// archiveOrphanAttachments moves the uploaded files of the chat that no
+// other visible chat references anymore to ArchivePath.
+func (s *Service) archiveOrphanAttachments(chat Chat) []string {
+	names := s.orphanAttachments(chat)
+	if len(names) == 0 {
+		return names
+	}
+
+	if err := os.MkdirAll(ArchivePath, 0755); err != nil {
+		log.Printf("could not create the archive: %v", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(UploadPath, name), filepath.Join(ArchivePath, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("could not archive attachment %s: %v", name, err)
+			continue
+		}
+		if _, err := s.db.Collection("uploads").DeleteOne(ctx, bson.M{"name": name}); err != nil {
+			log.Printf("could not forget upload %s: %v", name, err)
+		}
+	}
+
+	return names
+}
+
+func retentionAction(room Room) string {
+	if room.RetentionAction == "" {
+		return RetentionDelete
+	}
+	return room.RetentionAction
+}
@@ -0,0 +1,726 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// HistoryFromJoin lets members read only messages sent after they joined.
+	HistoryFromJoin = "joined"
+	// HistoryAll lets members read the whole room history.
+	HistoryAll = "all"
+
+	// RoleOwner is the role of the member that owns a room.
+	RoleOwner = "owner"
+	// RoleModerator is the role of members that can moderate a room.
+	RoleModerator = "moderator"
+	// RoleMember is the role of a regular room member.
+	RoleMember = "member"
+
+	inviteTokenSize = 16
+	maxTopicLength  = 250
+)
+
+var (
+	// ErrRoomNotFound used when the room wasn't found on the db.
+	ErrRoomNotFound = errors.New("room not found")
+	// ErrNotRoomMember used when the user is not a member of the room.
+	ErrNotRoomMember = errors.New("not a member of the room")
+	// ErrNotRoomOwner used when an action requires the room owner.
+	ErrNotRoomOwner = errors.New("only the room owner can do that")
+	// ErrNotRoomModerator used when an action requires a room moderator.
+	ErrNotRoomModerator = errors.New("only room moderators can do that")
+	// ErrAlreadyRoomMember used when the user is already a member of the room.
+	ErrAlreadyRoomMember = errors.New("already a member of the room")
+	// ErrOwnerCannotLeave used when the owner tries to leave without transferring ownership.
+	ErrOwnerCannotLeave = errors.New("owner must transfer ownership before leaving")
+	// ErrInvalidMuteUntil used when muting a room until a time in the past.
+	ErrInvalidMuteUntil = errors.New("invalid mute time")
+	// ErrPrivateRoom used when joining a private room without an invitation.
+	ErrPrivateRoom = errors.New("room is private")
+	// ErrInvalidRoomName used when the room name is empty.
+	ErrInvalidRoomName = errors.New("invalid room name")
+	// ErrInvalidTopic used when the room topic is too long.
+	ErrInvalidTopic = errors.New("invalid room topic")
+	// ErrInvalidHistoryVisibility used when the history visibility is unknown.
+	ErrInvalidHistoryVisibility = errors.New("invalid history visibility")
+	// ErrInvalidRole used when the member role is unknown or can't be assigned.
+	ErrInvalidRole = errors.New("invalid role")
+	// ErrInviteNotFound used when the invite doesn't exist, expired or ran out of uses.
+	ErrInviteNotFound = errors.New("invite not found or expired")
+)
+
+type Room struct {
+	ID                primitive.ObjectID `bson:"_id" json:"id"`
+	Name              string             `bson:"name" json:"name"`
+	Topic             string             `bson:"topic,omitempty" json:"topic,omitempty"`
+	Private           bool               `bson:"private" json:"private"`
+	Owner             primitive.ObjectID `bson:"owner" json:"owner"`
+	HistoryVisibility string             `bson:"history_visibility" json:"history_visibility"`
+	PinPermission     string             `bson:"pin_permission" json:"pin_permission"`
+	PinCount          int                `bson:"pin_count" json:"pin_count"`
+	// MessageTTL is how many seconds messages live by default, zero to keep them.
+	MessageTTL int64 `bson:"message_ttl,omitempty" json:"message_ttl,omitempty"`
+	// RetentionDays is how many days chats are kept, zero to keep them
+	// forever. RetentionAction tells whether older ones are deleted or archived.
+	RetentionDays   int       `bson:"retention_days,omitempty" json:"retention_days,omitempty"`
+	RetentionAction string    `bson:"retention_action,omitempty" json:"retention_action,omitempty"`
+	CreatedAt       time.Time `bson:"created_at" json:"created_at,omitempty"`
+	UpdatedAt       time.Time `bson:"updated_at" json:"updated_at,omitempty"`
+}
+
+type RoomMember struct {
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	Room     primitive.ObjectID `bson:"room" json:"room"`
+	User     primitive.ObjectID `bson:"user" json:"user"`
+	Role     string             `bson:"role" json:"role"`
+	JoinedAt time.Time          `bson:"joined_at" json:"joined_at"`
+	// Muted members get no notifications from the room, until MutedUntil
+	// when it is set.
+	Muted      bool       `bson:"muted,omitempty" json:"muted,omitempty"`
+	MutedUntil *time.Time `bson:"muted_until,omitempty" json:"muted_until,omitempty"`
+}
+
+type RoomInvite struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Room      primitive.ObjectID `bson:"room" json:"room"`
+	Token     string             `bson:"token" json:"token"`
+	CreatedBy primitive.ObjectID `bson:"created_by" json:"created_by"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	MaxUses   int                `bson:"max_uses" json:"max_uses"`
+	Uses      int                `bson:"uses" json:"uses"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// RoomSettings holds the room fields that can be changed after creation.
+// Nil fields are left untouched.
+type RoomSettings struct {
+	Name              *string
+	Topic             *string
+	HistoryVisibility *string
+	PinPermission     *string
+	MessageTTL        *int64
+}
+
+func validHistoryVisibility(v string) bool {
+	return v == HistoryFromJoin || v == HistoryAll
+}
+
+// CreateRoom creates a room owned by the authenticated user.
+func (s *Service) CreateRoom(ctx context.Context, name string, private bool, historyVisibility string) (Room, error) {
+	var room Room
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return room, err
+	}
+
+	if name == "" {
+		return room, ErrInvalidRoomName
+	}
+
+	if historyVisibility == "" {
+		historyVisibility = HistoryAll
+	}
+	if !validHistoryVisibility(historyVisibility) {
+		return room, ErrInvalidHistoryVisibility
+	}
+
+	now := time.Now()
+	room = Room{
+		ID:                primitive.NewObjectID(),
+		Name:              name,
+		Private:           private,
+		Owner:             uid,
+		HistoryVisibility: historyVisibility,
+		PinPermission:     PinByMembers,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Collection("rooms").InsertOne(ctx, room); err != nil {
+		return room, err
+	}
+
+	if err := s.addRoomMember(room.ID, uid, RoleOwner); err != nil {
+		return room, err
+	}
+
+	return room, nil
+}
+
+// GetRooms lists the public rooms and the rooms the authenticated user belongs to.
+func (s *Service) GetRooms(ctx context.Context) ([]Room, error) {
+	rooms := []Room{}
+
+	filter := bson.M{"private": false}
+	if uid, err := s.AuthUserID(ctx); err == nil {
+		ids, err := s.RoomIDsForUser(uid)
+		if err != nil {
+			return rooms, err
+		}
+		filter = bson.M{"$or": bson.A{
+			bson.M{"private": false},
+			bson.M{"_id": bson.M{"$in": ids}},
+		}}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := s.db.Collection("rooms").Find(ctx, filter)
+	if err != nil {
+		return rooms, err
+	}
+	defer cur.Close(ctx)
+
+	if err := cur.All(ctx, &rooms); err != nil {
+		return rooms, err
+	}
+
+	return rooms, nil
+}
+
+// GetRoom retrieves a room the authenticated user is allowed to see.
+func (s *Service) GetRoom(ctx context.Context, roomID primitive.ObjectID) (Room, error) {
+	uid, _ := s.AuthUserID(ctx)
+	room, _, err := s.roomAccess(roomID, uid)
+	return room, err
+}
+
+// UpdateRoom changes the room settings. Only the owner may do it.
+func (s *Service) UpdateRoom(ctx context.Context, roomID primitive.ObjectID, settings RoomSettings) (Room, error) {
+	room, owner, err := s.ownedRoom(ctx, roomID)
+	if err != nil {
+		return room, err
+	}
+	before := room
+
+	set := bson.M{"updated_at": time.Now()}
+	if settings.Name != nil {
+		if *settings.Name == "" {
+			return room, ErrInvalidRoomName
+		}
+		set["name"] = *settings.Name
+	}
+	if settings.Topic != nil {
+		if utf8.RuneCountInString(*settings.Topic) > maxTopicLength {
+			return room, ErrInvalidTopic
+		}
+		set["topic"] = *settings.Topic
+	}
+	if settings.HistoryVisibility != nil {
+		if !validHistoryVisibility(*settings.HistoryVisibility) {
+			return room, ErrInvalidHistoryVisibility
+		}
+		set["history_visibility"] = *settings.HistoryVisibility
+	}
+	if settings.PinPermission != nil {
+		if !validPinPermission(*settings.PinPermission) {
+			return room, ErrInvalidPinPermission
+		}
+		set["pin_permission"] = *settings.PinPermission
+	}
+	if settings.MessageTTL != nil {
+		if !validMessageTTL(*settings.MessageTTL) {
+			return room, ErrInvalidMessageTTL
+		}
+		set["message_ttl"] = *settings.MessageTTL
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = s.db.Collection("rooms").FindOneAndUpdate(ctx, bson.M{"_id": roomID}, bson.M{"$set": set}, opts).Decode(&room)
+	if err != nil {
+		return room, err
+	}
+
+	if room.Name != before.Name {
+		s.postSystemMessage(roomID, owner, SystemEvent{Event: EventRoomRenamed, From: before.Name, To: room.Name})
+	}
+	if room.Topic != before.Topic {
+		s.postSystemMessage(roomID, owner, SystemEvent{Event: EventTopicChanged, From: before.Topic, To: room.Topic})
+	}
+
+	return room, nil
+}
+
+// JoinRoom adds the authenticated user to a public room.
+func (s *Service) JoinRoom(ctx context.Context, roomID primitive.ObjectID) (Room, error) {
+	var room Room
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return room, err
+	}
+
+	room, err = s.findRoom(roomID)
+	if err != nil {
+		return room, err
+	}
+	if room.Private {
+		return room, ErrPrivateRoom
+	}
+
+	if err := s.addRoomMember(room.ID, uid, RoleMember); err != nil {
+		return room, err
+	}
+	s.postSystemMessage(room.ID, uid, SystemEvent{Event: EventMemberJoined})
+
+	return room, nil
+}
+
+// LeaveRoom removes the authenticated user from the room.
+func (s *Service) LeaveRoom(ctx context.Context, roomID primitive.ObjectID) error {
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return err
+	}
+
+	m, err := s.findRoomMember(roomID, uid)
+	if err != nil {
+		return err
+	}
+	if m.Role == RoleOwner {
+		return ErrOwnerCannotLeave
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Collection("room_members").DeleteOne(ctx, bson.M{"_id": m.ID}); err != nil {
+		return err
+	}
+	s.postSystemMessage(roomID, uid, SystemEvent{Event: EventMemberLeft})
+
+	return nil
+}
+
+// MuteRoom stops the notifications of the room for the authenticated user
+// until the given time, or until unmuted when it is nil.
+func (s *Service) MuteRoom(ctx context.Context, roomID primitive.ObjectID, until *time.Time) (RoomMember, error) {
+	return s.setRoomMuted(ctx, roomID, true, until)
+}
+
+// UnmuteRoom turns the notifications of the room back on for the
+// authenticated user.
+func (s *Service) UnmuteRoom(ctx context.Context, roomID primitive.ObjectID) (RoomMember, error) {
+	return s.setRoomMuted(ctx, roomID, false, nil)
+}
+
+func (s *Service) setRoomMuted(ctx context.Context, roomID primitive.ObjectID, muted bool, until *time.Time) (RoomMember, error) {
+	var m RoomMember
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return m, err
+	}
+	if until != nil && !until.After(time.Now()) {
+		return m, ErrInvalidMuteUntil
+	}
+
+	update := bson.M{"$unset": bson.M{"muted": "", "muted_until": ""}}
+	if muted {
+		update = bson.M{"$set": bson.M{"muted": true}, "$unset": bson.M{"muted_until": ""}}
+		if until != nil {
+			update = bson.M{"$set": bson.M{"muted": true, "muted_until": *until}}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = s.db.Collection("room_members").FindOneAndUpdate(ctx, bson.M{"room": roomID, "user": uid}, update, opts).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return m, ErrNotRoomMember
+	}
+
+	return m, err
+}
+
+// mutedMembers lists which of the users muted the room.
+func (s *Service) mutedMembers(roomID primitive.ObjectID, users []primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	muted := make(map[primitive.ObjectID]bool)
+	if roomID.IsZero() || len(users) == 0 {
+		return muted, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{
+		"room":        roomID,
+		"user":        bson.M{"$in": users},
+		"muted":       true,
+		"muted_until": bson.M{"$not": bson.M{"$lte": time.Now()}},
+	}
+	cur, err := s.db.Collection("room_members").Find(ctx, filter)
+	if err != nil {
+		return muted, err
+	}
+	var members []RoomMember
+	if err := cur.All(ctx, &members); err != nil {
+		return muted, err
+	}
+	for _, m := range members {
+		muted[m.User] = true
+	}
+
+	return muted, nil
+}
+
+// AddRoomMember lets the owner add a user to the room by ID.
+func (s *Service) AddRoomMember(ctx context.Context, roomID, userID primitive.ObjectID) error {
+	_, owner, err := s.ownedRoom(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.findUserChatById(userID); err != nil {
+		return ErrUserNotFound
+	}
+
+	if err := s.addRoomMember(roomID, userID, RoleMember); err != nil {
+		return err
+	}
+	s.postSystemMessage(roomID, owner, SystemEvent{Event: EventMemberAdded, User: &userID})
+
+	return nil
+}
+
+// GetRoomMembers lists the members of a room the authenticated user can see.
+func (s *Service) GetRoomMembers(ctx context.Context, roomID primitive.ObjectID) ([]RoomMember, error) {
+	members := []RoomMember{}
+
+	if _, err := s.GetRoom(ctx, roomID); err != nil {
+		return members, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := s.db.Collection("room_members").Find(ctx, bson.M{"room": roomID})
+	if err != nil {
+		return members, err
+	}
+	defer cur.Close(ctx)
+
+	err = cur.All(ctx, &members)
+
+	return members, err
+}
+
+// SetRoomMemberRole lets the owner promote a member to moderator or demote
+// them back to member.
+func (s *Service) SetRoomMemberRole(ctx context.Context, roomID, userID primitive.ObjectID, role string) error {
+	if role != RoleModerator && role != RoleMember {
+		return ErrInvalidRole
+	}
+
+	if _, _, err := s.ownedRoom(ctx, roomID); err != nil {
+		return err
+	}
+
+	m, err := s.findRoomMember(roomID, userID)
+	if err != nil {
+		return err
+	}
+	if m.Role == RoleOwner {
+		return ErrInvalidRole
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = s.db.Collection("room_members").UpdateOne(ctx, bson.M{"_id": m.ID}, bson.M{"$set": bson.M{"role": role}})
+
+	return err
+}
+
+// TransferOwnership hands the room over to another member.
+func (s *Service) TransferOwnership(ctx context.Context, roomID, newOwner primitive.ObjectID) error {
+	_, owner, err := s.ownedRoom(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if owner == newOwner {
+		// repairs the roles if an earlier transfer stopped halfway
+		return s.syncOwnerRole(roomID, owner)
+	}
+
+	if _, err := s.findRoomMember(roomID, newOwner); err != nil {
+		return err
+	}
+
+	// the room decides who owns it, the member roles follow from it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{"_id": roomID, "owner": owner}
+	res, err := s.db.Collection("rooms").UpdateOne(ctx, filter, bson.M{"$set": bson.M{"owner": newOwner, "updated_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		// someone else transferred it first
+		return ErrNotRoomOwner
+	}
+
+	return s.syncOwnerRole(roomID, newOwner)
+}
+
+// syncOwnerRole gives the owner role to the owner of the room only.
+func (s *Service) syncOwnerRole(roomID, owner primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	members := s.db.Collection("room_members")
+	if _, err := members.UpdateOne(ctx, bson.M{"room": roomID, "user": owner}, bson.M{"$set": bson.M{"role": RoleOwner}}); err != nil {
+		return err
+	}
+	filter := bson.M{"room": roomID, "user": bson.M{"$ne": owner}, "role": RoleOwner}
+	_, err := members.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"role": RoleMember}})
+
+	return err
+}
+
+// CreateInvite creates a shareable invite link for the room. A zero ttl never
+// expires and zero maxUses allows unlimited uses.
+func (s *Service) CreateInvite(ctx context.Context, roomID primitive.ObjectID, ttl time.Duration, maxUses int) (RoomInvite, error) {
+	var invite RoomInvite
+
+	_, owner, err := s.ownedRoom(ctx, roomID)
+	if err != nil {
+		return invite, err
+	}
+
+	token, err := randomToken(inviteTokenSize)
+	if err != nil {
+		return invite, err
+	}
+
+	now := time.Now()
+	invite = RoomInvite{
+		ID:        primitive.NewObjectID(),
+		Room:      roomID,
+		Token:     token,
+		CreatedBy: owner,
+		MaxUses:   maxUses,
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		invite.ExpiresAt = now.Add(ttl)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = s.db.Collection("room_invites").InsertOne(ctx, invite)
+
+	return invite, err
+}
+
+// AcceptInvite adds the authenticated user to the room of the invite.
+func (s *Service) AcceptInvite(ctx context.Context, token string) (Room, error) {
+	var room Room
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return room, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	invites := s.db.Collection("room_invites")
+
+	var invite RoomInvite
+	err = invites.FindOne(ctx, bson.M{"token": token}).Decode(&invite)
+	if err == mongo.ErrNoDocuments {
+		return room, ErrInviteNotFound
+	}
+	if err != nil {
+		return room, err
+	}
+
+	if _, err := s.findRoomMember(invite.Room, uid); err == nil {
+		return room, ErrAlreadyRoomMember
+	}
+
+	// consume one use atomically so concurrent accepts can't exceed max_uses
+	now := time.Now()
+	filter := bson.M{
+		"_id": invite.ID,
+		"$and": bson.A{
+			bson.M{"$or": bson.A{bson.M{"expires_at": time.Time{}}, bson.M{"expires_at": bson.M{"$gt": now}}}},
+			bson.M{"$or": bson.A{bson.M{"max_uses": 0}, bson.M{"$expr": bson.M{"$lt": bson.A{"$uses", "$max_uses"}}}}},
+		},
+	}
+	res, err := invites.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"uses": 1}})
+	if err != nil {
+		return room, err
+	}
+	if res.ModifiedCount == 0 {
+		return room, ErrInviteNotFound
+	}
+
+	room, err = s.findRoom(invite.Room)
+	if err == nil {
+		err = s.addRoomMember(room.ID, uid, RoleMember)
+	}
+	if err != nil {
+		// the user didn't join, give the use back
+		invites.UpdateOne(ctx, bson.M{"_id": invite.ID}, bson.M{"$inc": bson.M{"uses": -1}})
+		return room, err
+	}
+	s.postSystemMessage(room.ID, uid, SystemEvent{Event: EventMemberJoined})
+
+	return room, nil
+}
+
+// RoomIDsForUser lists the IDs of every room the user belongs to.
+func (s *Service) RoomIDsForUser(userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	ids := []primitive.ObjectID{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := s.db.Collection("room_members").Find(ctx, bson.M{"user": userID})
+	if err != nil {
+		return ids, err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var m RoomMember
+		if err := cur.Decode(&m); err != nil {
+			return ids, err
+		}
+		ids = append(ids, m.Room)
+	}
+
+	return ids, cur.Err()
+}
+
+// roomAccess checks whether the user can read the room. For rooms that only
+// show history from join, it also returns the moment the user joined.
+func (s *Service) roomAccess(roomID, userID primitive.ObjectID) (Room, time.Time, error) {
+	var since time.Time
+
+	room, err := s.findRoom(roomID)
+	if err != nil {
+		return room, since, err
+	}
+
+	m, err := s.findRoomMember(roomID, userID)
+	if err == ErrNotRoomMember && !room.Private {
+		return room, since, nil
+	}
+	if err != nil {
+		return room, since, err
+	}
+
+	if room.HistoryVisibility == HistoryFromJoin {
+		since = m.JoinedAt
+	}
+
+	return room, since, nil
+}
+
+// checkRoomAccess checks whether the user may read and send messages in the
+// room. The zero room is the public lobby.
+func (s *Service) checkRoomAccess(roomID, userID primitive.ObjectID) error {
+	if roomID.IsZero() {
+		return nil
+	}
+
+	_, _, err := s.roomAccess(roomID, userID)
+	return err
+}
+
+// isRoomModerator reports whether the user owns or moderates the room.
+func (s *Service) isRoomModerator(roomID, userID primitive.ObjectID) bool {
+	if roomID.IsZero() {
+		return false
+	}
+
+	m, err := s.findRoomMember(roomID, userID)
+	if err != nil {
+		return false
+	}
+
+	return m.Role == RoleOwner || m.Role == RoleModerator
+}
+
+func (s *Service) ownedRoom(ctx context.Context, roomID primitive.ObjectID) (Room, primitive.ObjectID, error) {
+	var room Room
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return room, uid, err
+	}
+
+	room, err = s.findRoom(roomID)
+	if err != nil {
+		return room, uid, err
+	}
+	if room.Owner != uid {
+		return room, uid, ErrNotRoomOwner
+	}
+
+	return room, uid, nil
+}
+
+func (s *Service) findRoom(id primitive.ObjectID) (Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	room := Room{}
+	err := s.db.Collection("rooms").FindOne(ctx, bson.M{"_id": id}).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		return room, ErrRoomNotFound
+	}
+
+	return room, err
+}
+
+func (s *Service) findRoomMember(roomID, userID primitive.ObjectID) (RoomMember, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m := RoomMember{}
+	err := s.db.Collection("room_members").FindOne(ctx, bson.M{"room": roomID, "user": userID}).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return m, ErrNotRoomMember
+	}
+
+	return m, err
+}
+
+func (s *Service) addRoomMember(roomID, userID primitive.ObjectID, role string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m := RoomMember{
+		ID:       primitive.NewObjectID(),
+		Room:     roomID,
+		User:     userID,
+		Role:     role,
+		JoinedAt: time.Now(),
+	}
+	_, err := s.db.Collection("room_members").InsertOne(ctx, m)
+	if isDuplicateKeyError(err) {
+		return ErrAlreadyRoomMember
+	}
+
+	return err
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", b), nil
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxSavedNoteLength = 1000
+
+var (
+	// ErrNotSaved used when unsaving a message that isn't saved.
+	ErrNotSaved = errors.New("message is not saved")
+	// ErrInvalidNote used when the note of a saved message is too long.
+	ErrInvalidNote = errors.New("invalid note")
+	// ErrInvalidRemindAt used when the reminder of a saved message is in the past.
+	ErrInvalidRemindAt = errors.New("invalid reminder time")
+)
+
+// SavedChat is a message a user bookmarked, with an optional note and a
+// reminder sent to them at RemindAt.
+type SavedChat struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	User       primitive.ObjectID `bson:"user" json:"-"`
+	Chat       primitive.ObjectID `bson:"chat" json:"chat"`
+	Room       primitive.ObjectID `bson:"room,omitempty" json:"room,omitempty"`
+	Note       string             `bson:"note,omitempty" json:"note,omitempty"`
+	RemindAt   *time.Time         `bson:"remind_at,omitempty" json:"remind_at,omitempty"`
+	RemindedAt *time.Time         `bson:"reminded_at,omitempty" json:"reminded_at,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+type savedOutput struct {
+	SavedChat
+	Message chatOutput `json:"message"`
+}
+
+// SaveChatForLater bookmarks a message the authenticated user can see. Saving
+// it again replaces the note and the reminder.
+func (s *Service) SaveChatForLater(ctx context.Context, chatID primitive.ObjectID, note string, remindAt *time.Time) (savedOutput, error) {
+	var out savedOutput
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return out, err
+	}
+	if len([]rune(note)) > maxSavedNoteLength {
+		return out, ErrInvalidNote
+	}
+	if remindAt != nil && !remindAt.After(time.Now()) {
+		return out, ErrInvalidRemindAt
+	}
+
+	chat, err := s.findChat(chatID)
+	if err != nil {
+		return out, err
+	}
+	if !s.canSeeChat(uid, chat) {
+		return out, ErrChatNotFound
+	}
+
+	now := time.Now()
+	set := bson.M{"room": chat.Room, "note": note, "updated_at": now}
+	unset := bson.M{"reminded_at": ""}
+	if remindAt != nil {
+		set["remind_at"] = *remindAt
+	} else {
+		unset["remind_at"] = ""
+	}
+	if chat.Room.IsZero() {
+		delete(set, "room")
+	}
+	if note == "" {
+		delete(set, "note")
+		unset["note"] = ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{"user": uid, "chat": chat.ID}
+	update := bson.M{
+		"$set":         set,
+		"$unset":       unset,
+		"$setOnInsert": bson.M{"_id": primitive.NewObjectID(), "created_at": now},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	saved := s.db.Collection("saved_chats")
+	err = saved.FindOneAndUpdate(ctx, filter, update, opts).Decode(&out.SavedChat)
+	if isDuplicateKeyError(err) {
+		// saved concurrently, ours replaces it
+		err = saved.FindOneAndUpdate(ctx, filter, update, opts.SetUpsert(false)).Decode(&out.SavedChat)
+	}
+	if err != nil {
+		return out, err
+	}
+
+	chats, err := s.chatOutputs(uid, []Chat{chat})
+	if err != nil {
+		return out, err
+	}
+	out.Message = chats[0]
+
+	return out, nil
+}
+
+// UnsaveChat removes the bookmark of the authenticated user on a message.
+func (s *Service) UnsaveChat(ctx context.Context, chatID primitive.ObjectID) error {
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := s.db.Collection("saved_chats").DeleteOne(ctx, bson.M{"user": uid, "chat": chatID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotSaved
+	}
+
+	return nil
+}
+
+// GetSavedChats lists the messages the authenticated user saved, latest
+// first. Messages that were deleted, expired or that the user can't see
+// anymore are shown as tombstones.
+func (s *Service) GetSavedChats(ctx context.Context) ([]savedOutput, error) {
+	outs := []savedOutput{}
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return outs, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+	cur, err := s.db.Collection("saved_chats").Find(ctx, bson.M{"user": uid}, opts)
+	if err != nil {
+		return outs, err
+	}
+	var saved []SavedChat
+	if err := cur.All(ctx, &saved); err != nil {
+		return outs, err
+	}
+
+	for _, sc := range saved {
+		out, err := s.savedOutput(uid, sc)
+		if err != nil {
+			return outs, err
+		}
+		outs = append(outs, out)
+	}
+
+	return outs, nil
+}
+
+// RunReminders sends the reminders of saved messages that are due every
+// interval until ctx is done. Each one is claimed atomically, so it is sent
+// once however many instances run it.
+func (s *Service) RunReminders(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			sc, ok, err := s.claimReminder()
+			if err != nil {
+				log.Printf("could not claim reminders: %v", err)
+				break
+			}
+			if !ok {
+				break
+			}
+
+			out, err := s.savedOutput(sc.User, sc)
+			if err != nil {
+				log.Printf("could not send reminder %s: %v", sc.ID.Hex(), err)
+				continue
+			}
+			s.events.Notify(sc.User, "saved_reminder", out)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) claimReminder() (SavedChat, bool, error) {
+	var sc SavedChat
+
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{"remind_at": bson.M{"$lte": now}, "reminded_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"reminded_at": now}}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"remind_at": 1}).SetReturnDocument(options.After)
+	err := s.db.Collection("saved_chats").FindOneAndUpdate(ctx, filter, update, opts).Decode(&sc)
+	if err == mongo.ErrNoDocuments {
+		return sc, false, nil
+	}
+	if err != nil {
+		return sc, false, err
+	}
+
+	return sc, true, nil
+}
+
+// savedOutput hydrates a saved message as the user sees it now.
+func (s *Service) savedOutput(uid primitive.ObjectID, sc SavedChat) (savedOutput, error) {
+	out := savedOutput{SavedChat: sc}
+
+	chat, err := s.findChat(sc.Chat)
+	if err != nil && err != ErrChatNotFound {
+		return out, err
+	}
+	if err == ErrChatNotFound || !s.canSeeChat(uid, chat) {
+		// gone for good, the tombstone keeps the bookmark in place
+		gone := sc.UpdatedAt
+		out.Message = chatOutput{ID: sc.Chat, Room: sc.Room, DeletedAt: &gone}
+		return out, nil
+	}
+
+	chats, err := s.chatOutputs(uid, []Chat{chat})
+	if err != nil {
+		return out, err
+	}
+	out.Message = chats[0]
+
+	return out, nil
+}
+
+// canSeeChat reports whether the user may read the chat: it hasn't expired
+// and is in a room whose history the user can read.
+func (s *Service) canSeeChat(uid primitive.ObjectID, chat Chat) bool {
+	if chat.ExpiresAt != nil && !chat.ExpiresAt.After(time.Now()) {
+		return false
+	}
+	if chat.Room.IsZero() {
+		return true
+	}
+
+	_, since, err := s.roomAccess(chat.Room, uid)
+	if err != nil {
+		return false
+	}
+
+	return since.IsZero() || !chat.CreatedAt.Before(since)
+}
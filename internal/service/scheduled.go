@@ -0,0 +1,361 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses of a scheduled chat.
+const (
+	ScheduledPending = "pending"
+	ScheduledSending = "sending"
+	ScheduledSent    = "sent"
+	ScheduledFailed  = "failed"
+)
+
+const (
+	// scheduleLease is how long a dispatcher owns a claimed message. If it
+	// dies before finishing, another one picks the message up afterwards.
+	scheduleLease       = time.Minute
+	maxScheduleAttempts = 5
+	maxScheduleAhead    = 365 * 24 * time.Hour
+)
+
+var (
+	// ErrScheduledNotFound used when the scheduled chat wasn't found on the db.
+	ErrScheduledNotFound = errors.New("scheduled message not found")
+	// ErrScheduledSending used when changing a scheduled chat that is already being sent.
+	ErrScheduledSending = errors.New("scheduled message is already being sent")
+	// ErrInvalidSendAt used when the send time is in the past or too far ahead.
+	ErrInvalidSendAt = errors.New("invalid send time")
+)
+
+// ScheduledChat is a chat waiting to be sent at SendAt. Once sent, ChatID
+// is the ID of the chat.
+type ScheduledChat struct {
+	ID          primitive.ObjectID  `bson:"_id" json:"id"`
+	Chat        Chat                `bson:"chat" json:"chat"`
+	ChatID      *primitive.ObjectID `bson:"chat_id,omitempty" json:"chat_id,omitempty"`
+	SendAt      time.Time           `bson:"send_at" json:"send_at"`
+	Status      string              `bson:"status" json:"status"`
+	Error       string              `bson:"error,omitempty" json:"error,omitempty"`
+	Attempts    int                 `bson:"attempts" json:"-"`
+	LockedUntil time.Time           `bson:"locked_until" json:"-"`
+	SentAt      *time.Time          `bson:"sent_at,omitempty" json:"sent_at,omitempty"`
+	CreatedAt   time.Time           `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time           `bson:"updated_at" json:"updated_at"`
+}
+
+// ScheduledChatUpdate holds the fields of a scheduled chat that can be
+// changed before it is sent. Nil fields are left untouched.
+type ScheduledChatUpdate struct {
+	Message *string
+	Payload *Payload
+	SendAt  *time.Time
+}
+
+// ScheduleChat stores a chat of the authenticated user to be sent at sendAt.
+// It is validated now and again when sent.
+func (s *Service) ScheduleChat(ctx context.Context, c Chat, sendAt time.Time) (ScheduledChat, error) {
+	var sc ScheduledChat
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return sc, err
+	}
+	if err := validSendAt(sendAt); err != nil {
+		return sc, err
+	}
+
+	now := time.Now()
+	c.ID = primitive.NilObjectID
+	c.Sender = uid
+	c.CreatedAt = time.Time{}
+	if err := s.validateScheduled(&c); err != nil {
+		return sc, err
+	}
+
+	sc = ScheduledChat{
+		ID:        primitive.NewObjectID(),
+		Chat:      c,
+		SendAt:    sendAt,
+		Status:    ScheduledPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = s.db.Collection("scheduled_messages").InsertOne(ctx, sc)
+
+	return sc, err
+}
+
+// GetScheduledChats lists the chats the authenticated user scheduled and
+// that weren't sent yet, soonest first.
+func (s *Service) GetScheduledChats(ctx context.Context) ([]ScheduledChat, error) {
+	scheduled := []ScheduledChat{}
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return scheduled, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{"chat.sender": uid, "status": bson.M{"$ne": ScheduledSent}}
+	opts := options.Find().SetSort(bson.M{"send_at": 1})
+	cur, err := s.db.Collection("scheduled_messages").Find(ctx, filter, opts)
+	if err != nil {
+		return scheduled, err
+	}
+	defer cur.Close(ctx)
+
+	err = cur.All(ctx, &scheduled)
+
+	return scheduled, err
+}
+
+// UpdateScheduledChat changes a pending scheduled chat of the authenticated
+// user. Failed ones are scheduled again.
+func (s *Service) UpdateScheduledChat(ctx context.Context, id primitive.ObjectID, update ScheduledChatUpdate) (ScheduledChat, error) {
+	sc, err := s.ownScheduledChat(ctx, id)
+	if err != nil {
+		return sc, err
+	}
+
+	c := sc.Chat
+	if update.Message != nil {
+		c.Message = *update.Message
+	}
+	if update.Payload != nil {
+		c.Payload = update.Payload
+	}
+	sendAt := sc.SendAt
+	if update.SendAt != nil {
+		sendAt = *update.SendAt
+	}
+	if err := validSendAt(sendAt); err != nil {
+		return sc, err
+	}
+	if err := s.validateScheduled(&c); err != nil {
+		return sc, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{"_id": id, "status": bson.M{"$in": bson.A{ScheduledPending, ScheduledFailed}}}
+	set := bson.M{
+		"chat":       c,
+		"send_at":    sendAt,
+		"status":     ScheduledPending,
+		"attempts":   0,
+		"updated_at": time.Now(),
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = s.db.Collection("scheduled_messages").FindOneAndUpdate(ctx, filter, bson.M{"$set": set, "$unset": bson.M{"error": ""}}, opts).Decode(&sc)
+	if err == mongo.ErrNoDocuments {
+		return sc, ErrScheduledSending
+	}
+
+	return sc, err
+}
+
+// CancelScheduledChat drops a scheduled chat of the authenticated user that
+// wasn't sent yet.
+func (s *Service) CancelScheduledChat(ctx context.Context, id primitive.ObjectID) error {
+	if _, err := s.ownScheduledChat(ctx, id); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{"_id": id, "status": bson.M{"$in": bson.A{ScheduledPending, ScheduledFailed}}}
+	res, err := s.db.Collection("scheduled_messages").DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrScheduledSending
+	}
+
+	return nil
+}
+
+// RunScheduler sends the scheduled chats that are due every interval until
+// ctx is done. Messages are claimed atomically, so any number of instances
+// can run it at once, and everything lives in the db, so nothing is lost on
+// restart.
+func (s *Service) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			sc, ok, err := s.claimScheduledChat()
+			if err != nil {
+				log.Printf("could not claim scheduled messages: %v", err)
+				break
+			}
+			if !ok {
+				break
+			}
+			s.dispatchScheduledChat(sc)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimScheduledChat takes one due chat, including the ones whose dispatcher
+// died while sending them.
+func (s *Service) claimScheduledChat() (ScheduledChat, bool, error) {
+	var sc ScheduledChat
+
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{
+		"send_at": bson.M{"$lte": now},
+		"$or": bson.A{
+			bson.M{"status": ScheduledPending},
+			bson.M{"status": ScheduledSending, "locked_until": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{"status": ScheduledSending, "locked_until": now.Add(scheduleLease), "updated_at": now},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"send_at": 1}).SetReturnDocument(options.After)
+	err := s.db.Collection("scheduled_messages").FindOneAndUpdate(ctx, filter, update, opts).Decode(&sc)
+	if err == mongo.ErrNoDocuments {
+		return sc, false, nil
+	}
+	if err != nil {
+		return sc, false, err
+	}
+
+	return sc, true, nil
+}
+
+// dispatchScheduledChat sends a claimed chat. The chat records the ID of
+// the scheduled chat, which is unique, so a retry after a crash finds it
+// already sent.
+func (s *Service) dispatchScheduledChat(sc ScheduledChat) {
+	c := sc.Chat
+	c.ID = primitive.NewObjectID()
+	c.ScheduledID = &sc.ID
+
+	_, err := s.SaveChat(c)
+	if isDuplicateKeyError(err) {
+		c.ID, err = s.scheduledChatID(sc.ID)
+	}
+	if err != nil {
+		log.Printf("could not send scheduled message %s: %v", sc.ID.Hex(), err)
+
+		if _, ok := err.(*ValidationError); !ok && sc.Attempts < maxScheduleAttempts && !isAccessError(err) {
+			// keep it claimed, another attempt follows once the lease is over
+			return
+		}
+
+		sc.Status = ScheduledFailed
+		sc.Error = err.Error()
+		s.finishScheduledChat(sc, bson.M{"status": sc.Status, "error": sc.Error})
+		s.events.Notify(c.Sender, "scheduled_failed", sc)
+		return
+	}
+
+	now := time.Now()
+	sc.Status = ScheduledSent
+	sc.SentAt = &now
+	sc.ChatID = &c.ID
+	s.finishScheduledChat(sc, bson.M{"status": sc.Status, "sent_at": now, "chat_id": c.ID})
+	s.events.Notify(c.Sender, "scheduled_sent", sc)
+}
+
+// scheduledChatID finds the chat an earlier attempt sent.
+func (s *Service) scheduledChatID(id primitive.ObjectID) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var chat Chat
+	opts := options.FindOne().SetProjection(bson.M{"_id": 1})
+	err := s.db.Collection("chats").FindOne(ctx, bson.M{"scheduled_id": id}, opts).Decode(&chat)
+
+	return chat.ID, err
+}
+
+func (s *Service) finishScheduledChat(sc ScheduledChat, set bson.M) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	set["updated_at"] = time.Now()
+	if _, err := s.db.Collection("scheduled_messages").UpdateOne(ctx, bson.M{"_id": sc.ID}, bson.M{"$set": set}); err != nil {
+		log.Printf("could not update scheduled message %s: %v", sc.ID.Hex(), err)
+	}
+}
+
+// ownScheduledChat finds a scheduled chat of the authenticated user.
+func (s *Service) ownScheduledChat(ctx context.Context, id primitive.ObjectID) (ScheduledChat, error) {
+	var sc ScheduledChat
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return sc, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.db.Collection("scheduled_messages").FindOne(ctx, bson.M{"_id": id, "chat.sender": uid}).Decode(&sc)
+	if err == mongo.ErrNoDocuments {
+		return sc, ErrScheduledNotFound
+	}
+	if err != nil {
+		return sc, err
+	}
+	if sc.Status == ScheduledSending || sc.Status == ScheduledSent {
+		return sc, ErrScheduledSending
+	}
+
+	return sc, nil
+}
+
+// validateScheduled runs the checks SaveChat would run now.
+func (s *Service) validateScheduled(c *Chat) error {
+	if err := s.validateChat(c); err != nil {
+		return err
+	}
+	if err := s.checkRoomAccess(c.Room, c.Sender); err != nil {
+		return err
+	}
+
+	return s.validateParent(*c)
+}
+
+func validSendAt(t time.Time) error {
+	if !t.After(time.Now()) || time.Until(t) > maxScheduleAhead {
+		return ErrInvalidSendAt
+	}
+
+	return nil
+}
+
+// isAccessError reports whether retrying can't help because the sender lost
+// access to where the chat goes.
+func isAccessError(err error) bool {
+	switch err {
+	case ErrNotRoomMember, ErrRoomNotFound, ErrInvalidParent, ErrPrivateRoom:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// ErrInvalidSearch used when the search query can't be understood.
+var ErrInvalidSearch = errors.New("invalid search query")
+
+// SearchQuery is a parsed search. Free text terms go to the text index and
+// from:, in:, before:, after: and has:file narrow the results down.
+type SearchQuery struct {
+	Text    string
+	From    string
+	Room    *primitive.ObjectID
+	Before  time.Time
+	After   time.Time
+	HasFile bool
+	Page    int
+	Limit   int
+}
+
+type highlight struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+type searchResult struct {
+	Chat       chatOutput  `json:"chat"`
+	Highlights []highlight `json:"highlights"`
+}
+
+type searchOutput struct {
+	Results []searchResult `json:"results"`
+	Page    int            `json:"page"`
+	Limit   int            `json:"limit"`
+	HasMore bool           `json:"has_more"`
+}
+
+// ParseSearchQuery splits a query like "deploy from:bob after:2020-01-01"
+// into its text and filters.
+func ParseSearchQuery(q string, page, limit int) (SearchQuery, error) {
+	query := SearchQuery{Page: page, Limit: limit}
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.Limit < 1 {
+		query.Limit = defaultSearchLimit
+	}
+	if query.Limit > maxSearchLimit {
+		query.Limit = maxSearchLimit
+	}
+
+	var terms []string
+	for _, field := range strings.Fields(q) {
+		i := strings.Index(field, ":")
+		if i < 1 {
+			terms = append(terms, field)
+			continue
+		}
+
+		value := field[i+1:]
+		var err error
+		switch strings.ToLower(field[:i]) {
+		case "from":
+			query.From = strings.ToLower(strings.TrimPrefix(value, "@"))
+		case "in":
+			var id primitive.ObjectID
+			id, err = primitive.ObjectIDFromHex(value)
+			query.Room = &id
+		case "before":
+			query.Before, err = time.Parse("2006-01-02", value)
+		case "after":
+			query.After, err = time.Parse("2006-01-02", value)
+		case "has":
+			if value != "file" {
+				err = ErrInvalidSearch
+			}
+			query.HasFile = true
+		default:
+			terms = append(terms, field)
+		}
+		if err != nil {
+			return query, ErrInvalidSearch
+		}
+	}
+	query.Text = strings.Join(terms, " ")
+
+	if query.Text == "" && query.From == "" && query.Room == nil &&
+		query.Before.IsZero() && query.After.IsZero() && !query.HasFile {
+		return query, ErrInvalidSearch
+	}
+
+	return query, nil
+}
+
+// SearchChats finds the messages matching the query among the ones the
+// authenticated user can read, best matches first.
+func (s *Service) SearchChats(ctx context.Context, query SearchQuery) (searchOutput, error) {
+	out := searchOutput{Results: []searchResult{}, Page: query.Page, Limit: query.Limit}
+
+	uid, _ := s.AuthUserID(ctx)
+
+	scope, err := s.readableScope(uid, query.Room)
+	if err != nil {
+		return out, err
+	}
+
+	filter := bson.M{
+		"$or":        scope,
+		"deleted_at": bson.M{"$exists": false},
+		"expires_at": notExpired(),
+	}
+	if query.Text != "" {
+		filter["$text"] = bson.M{"$search": query.Text}
+	}
+	if query.From != "" {
+		u, err := s.findUserByUsername(query.From)
+		if err == mongo.ErrNoDocuments {
+			// nobody by that name sent anything
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+		filter["sender"] = u.ID
+	}
+	created := bson.M{}
+	if !query.After.IsZero() {
+		created["$gte"] = primitive.NewObjectIDFromTimestamp(query.After)
+	}
+	if !query.Before.IsZero() {
+		created["$lt"] = primitive.NewObjectIDFromTimestamp(query.Before)
+	}
+	if len(created) > 0 {
+		filter["_id"] = created
+	}
+	if query.HasFile {
+		filter["$and"] = bson.A{bson.M{"$or": bson.A{
+			bson.M{"message": bson.M{"$regex": uploadRef.String()}},
+			bson.M{"payload.file": bson.M{"$exists": true}},
+		}}}
+	}
+
+	// fetch one more than asked to know whether there is another page
+	opts := options.Find().
+		SetSkip(int64((query.Page - 1) * query.Limit)).
+		SetLimit(int64(query.Limit + 1))
+	if query.Text != "" {
+		opts.SetProjection(bson.M{"score": bson.M{"$meta": "textScore"}})
+		opts.SetSort(bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "_id", Value: -1}})
+	} else {
+		opts.SetSort(bson.M{"_id": -1})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := s.db.Collection("chats").Find(ctx, filter, opts)
+	if err != nil {
+		return out, err
+	}
+	defer cur.Close(ctx)
+
+	var chats []Chat
+	if err := cur.All(ctx, &chats); err != nil {
+		return out, err
+	}
+	if len(chats) > query.Limit {
+		out.HasMore = true
+		chats = chats[:query.Limit]
+	}
+
+	outs, err := s.chatOutputs(uid, chats)
+	if err != nil {
+		return out, err
+	}
+
+	for _, chout := range outs {
+		out.Results = append(out.Results, searchResult{
+			Chat:       chout,
+			Highlights: highlights(chout.Message, query.Text),
+		})
+	}
+
+	return out, nil
+}
+
+// readableScope builds the filters matching every chat the user can read: the
+// lobby, public rooms and the rooms they belong to, respecting history
+// visibility. With a room, the scope is narrowed down to it.
+func (s *Service) readableScope(userID primitive.ObjectID, roomID *primitive.ObjectID) (bson.A, error) {
+	if roomID != nil {
+		_, since, err := s.roomAccess(*roomID, userID)
+		if err != nil {
+			return nil, err
+		}
+		return bson.A{roomScope(*roomID, since)}, nil
+	}
+
+	scope := bson.A{bson.M{"room": bson.M{"$exists": false}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := s.db.Collection("rooms").Find(ctx, bson.M{"private": false})
+	if err != nil {
+		return nil, err
+	}
+	var public []Room
+	if err := cur.All(ctx, &public); err != nil {
+		return nil, err
+	}
+
+	joined := make(map[primitive.ObjectID]bool)
+	if !userID.IsZero() {
+		cur, err := s.db.Collection("room_members").Find(ctx, bson.M{"user": userID})
+		if err != nil {
+			return nil, err
+		}
+		var members []RoomMember
+		if err := cur.All(ctx, &members); err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			_, since, err := s.roomAccess(m.Room, userID)
+			if err != nil {
+				continue
+			}
+			joined[m.Room] = true
+			scope = append(scope, roomScope(m.Room, since))
+		}
+	}
+
+	var others []primitive.ObjectID
+	for _, room := range public {
+		if !joined[room.ID] {
+			others = append(others, room.ID)
+		}
+	}
+	if len(others) > 0 {
+		scope = append(scope, bson.M{"room": bson.M{"$in": others}})
+	}
+
+	return scope, nil
+}
+
+func roomScope(roomID primitive.ObjectID, since time.Time) bson.M {
+	if since.IsZero() {
+		return bson.M{"room": roomID}
+	}
+
+	return bson.M{"room": roomID, "created_at": bson.M{"$gte": since}}
+}
+
+// highlights finds where the search terms appear in the message, in runes.
+func highlights(message, text string) []highlight {
+	out := []highlight{}
+
+	var terms []string
+	for _, term := range strings.Fields(text) {
+		term = strings.Trim(term, `"-`)
+		if term != "" {
+			terms = append(terms, regexp.QuoteMeta(term))
+		}
+	}
+	if len(terms) == 0 {
+		return out
+	}
+
+	re, err := regexp.Compile(`(?i)` + strings.Join(terms, "|"))
+	if err != nil {
+		return out
+	}
+
+	for _, m := range re.FindAllStringIndex(message, -1) {
+		out = append(out, highlight{
+			Offset: utf8.RuneCountInString(message[:m[0]]),
+			Length: utf8.RuneCountInString(message[m[0]:m[1]]),
+		})
+	}
+
+	return out
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// roomCounter holds the last sequence number given out in a room. The lobby
+// uses the zero ID.
+type roomCounter struct {
+	Room primitive.ObjectID `bson:"_id"`
+	Seq  int64              `bson:"seq"`
+}
+
+// nextSeq atomically takes the next sequence number of the room. Numbers
+// taken by chats that then fail to save are skipped, so the sequence only
+// ever grows but may have gaps.
+func (s *Service) nextSeq(roomID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var counter roomCounter
+	err := s.db.Collection("room_counters").FindOneAndUpdate(ctx, bson.M{"_id": roomID}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&counter)
+
+	return counter.Seq, err
+}
+
+// historyOrder sorts chats in the order they were sent. Chats from before
+// sequence numbers existed come first, by ID.
+func historyOrder() bson.D {
+	return bson.D{{Key: "seq", Value: 1}, {Key: "_id", Value: 1}}
+}
@@ -0,0 +1,16 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestHistoryOrder(t *testing.T) {
+	// chats without seq sort before any number, so legacy history stays first
+	want := bson.D{{Key: "seq", Value: 1}, {Key: "_id", Value: 1}}
+	if got := historyOrder(); !reflect.DeepEqual(got, want) {
+		t.Errorf("historyOrder() = %v, want %v", got, want)
+	}
+}
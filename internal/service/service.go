@@ -1,16 +1,223 @@
 package service
 
 import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Service struct {
-	db *mongo.Database
+	db     *mongo.Database
+	config Config
+	events Broadcaster
+}
+
+// Config holds the tunable behaviour of the service.
+type Config struct {
+	// EditWindow is how long after sending a message its sender may edit it.
+	EditWindow time.Duration
+	// MaxPinsPerRoom is how many messages a room can have pinned at once.
+	MaxPinsPerRoom int
+	// Unfurler fetches the previews of the links in messages. Links aren't
+	// unfurled when it's nil.
+	Unfurler Unfurler
+	// PreviewCacheTTL is how long fetched link previews are reused.
+	PreviewCacheTTL time.Duration
+	// PurgeBatchSize is how many chats the retention purge removes at once.
+	PurgeBatchSize int
+	// PublicURL is where the API is reachable from outside, used for the
+	// links of exports.
+	PublicURL string
+	// Admins are the emails of the users allowed to import history and to
+	// manage retention.
+	Admins []string
+	// LobbyRetentionDays is how many days the lobby keeps its chats, zero
+	// keeps them forever. LobbyRetentionAction is what happens to older
+	// ones, like the retention action of a room.
+	LobbyRetentionDays   int
+	LobbyRetentionAction string
 }
 
-func New(database *mongo.Database) *Service {
+func New(database *mongo.Database, config Config) *Service {
 
 	return &Service{
-		db: database,
+		db:     database,
+		config: config,
+		events: nopBroadcaster{},
 	}
 }
+
+// EnsureIndexes creates the indexes the service relies on.
+func (s *Service) EnsureIndexes(ctx context.Context) error {
+	indexes := map[string][]mongo.IndexModel{
+		"users": {
+			{
+				Keys:    bson.D{{Key: "username", Value: 1}},
+				Options: options.Index().SetUnique(true).SetSparse(true),
+			},
+		},
+		"notifications": {
+			{Keys: bson.D{{Key: "user", Value: 1}, {Key: "_id", Value: -1}}},
+		},
+		"room_members": {
+			{
+				Keys:    bson.D{{Key: "room", Value: 1}, {Key: "user", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.D{{Key: "user", Value: 1}}},
+		},
+		"room_invites": {
+			{
+				Keys:    bson.D{{Key: "token", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		},
+		"chats": {
+			{Keys: bson.D{{Key: "room", Value: 1}, {Key: "created_at", Value: 1}}},
+			{
+				Keys: bson.D{{Key: "room", Value: 1}, {Key: "seq", Value: 1}},
+				Options: options.Index().SetUnique(true).
+					SetPartialFilterExpression(bson.M{"seq": bson.M{"$exists": true}}),
+			},
+			{Keys: bson.D{{Key: "parent_id", Value: 1}, {Key: "_id", Value: 1}}},
+			{
+				Keys: bson.D{{Key: "room", Value: 1}, {Key: "updated_at", Value: 1}},
+				Options: options.Index().
+					SetPartialFilterExpression(bson.M{"updated_at": bson.M{"$exists": true}}),
+			},
+			{Keys: bson.D{{Key: "message", Value: "text"}}},
+			{
+				Keys: bson.D{{Key: "sender", Value: 1}, {Key: "client_msg_id", Value: 1}},
+				Options: options.Index().SetUnique(true).
+					SetPartialFilterExpression(bson.M{"client_msg_id": bson.M{"$exists": true}}),
+			},
+			{
+				Keys: bson.D{{Key: "scheduled_id", Value: 1}},
+				Options: options.Index().SetUnique(true).
+					SetPartialFilterExpression(bson.M{"scheduled_id": bson.M{"$exists": true}}),
+			},
+			{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(int32(expiryGrace.Seconds())),
+			},
+		},
+		"reactions": {
+			{
+				Keys:    bson.D{{Key: "chat", Value: 1}, {Key: "user", Value: 1}, {Key: "emoji", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.D{{Key: "chat", Value: 1}, {Key: "created_at", Value: 1}}},
+		},
+		"poll_votes": {
+			{
+				Keys:    bson.D{{Key: "chat", Value: 1}, {Key: "user", Value: 1}, {Key: "option", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{{Key: "chat", Value: 1}, {Key: "user", Value: 1}},
+				Options: options.Index().SetUnique(true).
+					SetPartialFilterExpression(bson.M{"single": true}),
+			},
+			{Keys: bson.D{{Key: "chat", Value: 1}, {Key: "created_at", Value: 1}}},
+		},
+		"read_states": {
+			{
+				Keys:    bson.D{{Key: "room", Value: 1}, {Key: "user", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		},
+		"delivery_states": {
+			{
+				Keys:    bson.D{{Key: "room", Value: 1}, {Key: "user", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		},
+		"pins": {
+			{
+				Keys:    bson.D{{Key: "room", Value: 1}, {Key: "chat", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		},
+		"chat_edits": {
+			{Keys: bson.D{{Key: "chat", Value: 1}, {Key: "edited_at", Value: 1}}},
+		},
+		"scheduled_messages": {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "send_at", Value: 1}}},
+			{Keys: bson.D{{Key: "chat.sender", Value: 1}, {Key: "send_at", Value: 1}}},
+		},
+		"export_jobs": {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+		},
+		"purge_runs": {
+			{Keys: bson.D{{Key: "room", Value: 1}, {Key: "started_at", Value: -1}}},
+		},
+		"uploads": {
+			{
+				Keys:    bson.D{{Key: "name", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		},
+		"saved_chats": {
+			{
+				Keys:    bson.D{{Key: "user", Value: 1}, {Key: "chat", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.D{{Key: "user", Value: 1}, {Key: "created_at", Value: -1}}},
+			{
+				Keys: bson.D{{Key: "remind_at", Value: 1}},
+				Options: options.Index().
+					SetPartialFilterExpression(bson.M{"reminded_at": bson.M{"$exists": false}}),
+			},
+		},
+		"command_runs": {
+			{
+				Keys:    bson.D{{Key: "sender", Value: 1}, {Key: "client_msg_id", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			},
+		},
+		"link_previews": {
+			{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			},
+		},
+	}
+
+	for name, models := range indexes {
+		if _, err := s.db.Collection(name).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isDuplicateKeyError(err error) bool {
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, we := range e.WriteErrors {
+			if we.Code == 11000 {
+				return true
+			}
+		}
+	case mongo.BulkWriteException:
+		// only when every failure is a duplicate, so the rest went through
+		for _, we := range e.WriteErrors {
+			if we.Code != 11000 {
+				return false
+			}
+		}
+		return len(e.WriteErrors) > 0 && e.WriteConcernError == nil
+	case mongo.CommandError:
+		return e.Code == 11000
+	}
+
+	return false
+}
@@ -0,0 +1,647 @@
+package service
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	importBatchSize = 500
+	// maxImportFileSize bounds each JSON file of the archive once
+	// uncompressed, so a small zip can't expand into all of the memory.
+	maxImportFileSize = 64 << 20
+)
+
+var (
+	// ErrInvalidImport used when the archive is not a Slack export.
+	ErrInvalidImport = errors.New("invalid slack export")
+	// ErrImportOutOfOrder used when imported messages are older than the ones
+	// already in the room, which would number them out of order.
+	ErrImportOutOfOrder = errors.New("room has newer messages than the import")
+	// ErrNotPlaceholder used when claiming a user that wasn't imported.
+	ErrNotPlaceholder = errors.New("user is not an imported placeholder")
+	// ErrImportTooLarge used when a file of the archive is too large.
+	ErrImportTooLarge = errors.New("slack export file is too large")
+)
+
+var (
+	slackUserTag    = regexp.MustCompile(`<@([A-Z0-9]+)(?:\|[^>]*)?>`)
+	slackChannelTag = regexp.MustCompile(`<#[A-Z0-9]+\|([^>]*)>`)
+	slackSpecialTag = regexp.MustCompile(`<!(here|channel|everyone)(?:\|[^>]*)?>`)
+	slackLinkTag    = regexp.MustCompile(`<((?:https?|mailto):[^|>]+)(?:\|([^>]*))?>`)
+)
+
+// ImportResult counts what an import found and what it created. Running an
+// import again only creates what the earlier runs didn't.
+type ImportResult struct {
+	Users        int `json:"users"`
+	UsersCreated int `json:"users_created"`
+	Rooms        int `json:"rooms"`
+	RoomsCreated int `json:"rooms_created"`
+	Chats        int `json:"chats"`
+	ChatsCreated int `json:"chats_created"`
+}
+
+// importRef links something imported from elsewhere to what it became here.
+type importRef struct {
+	Ref    string             `bson:"_id"`
+	Target primitive.ObjectID `bson:"target"`
+}
+
+type slackUser struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	RealName string `json:"real_name"`
+	Profile  struct {
+		Email       string `json:"email"`
+		FirstName   string `json:"first_name"`
+		LastName    string `json:"last_name"`
+		RealName    string `json:"real_name"`
+		DisplayName string `json:"display_name"`
+	} `json:"profile"`
+}
+
+type slackChannel struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Created int64    `json:"created"`
+	Members []string `json:"members"`
+	Topic   struct {
+		Value string `json:"value"`
+	} `json:"topic"`
+	Purpose struct {
+		Value string `json:"value"`
+	} `json:"purpose"`
+	private bool
+}
+
+type slackMessage struct {
+	Type     string `json:"type"`
+	Subtype  string `json:"subtype"`
+	User     string `json:"user"`
+	Text     string `json:"text"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+	Files    []struct {
+		Name      string `json:"name"`
+		Permalink string `json:"permalink"`
+	} `json:"files"`
+}
+
+// ImportSlack imports a Slack export archive: users.json, channels.json,
+// groups.json for private channels and a directory of daily message files
+// per channel. Slack users become the users with the same email, or
+// placeholders that can't log in. The authenticated user, who must be an
+// admin, owns the imported rooms. Messages can only be imported into rooms
+// that have nothing newer, so sequence numbers keep following send times.
+func (s *Service) ImportSlack(ctx context.Context, r io.ReaderAt, size int64) (ImportResult, error) {
+	var result ImportResult
+
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return result, err
+	}
+	if !s.isAdmin(ctx) {
+		return result, ErrNotAdmin
+	}
+
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return result, ErrInvalidImport
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range archive.File {
+		files[path.Clean(f.Name)] = f
+	}
+
+	var slackUsers []slackUser
+	if err := readZipJSON(files, "users.json", &slackUsers); err != nil {
+		return result, err
+	}
+	var channels, groups []slackChannel
+	if err := readZipJSON(files, "channels.json", &channels); err != nil {
+		return result, err
+	}
+	if _, ok := files["groups.json"]; ok {
+		if err := readZipJSON(files, "groups.json", &groups); err != nil {
+			return result, err
+		}
+		for i := range groups {
+			groups[i].private = true
+		}
+	}
+
+	users := make(map[string]UserChat)
+	for _, su := range slackUsers {
+		u, created, err := s.importSlackUser(su)
+		if err != nil {
+			return result, err
+		}
+		users[su.ID] = u
+		result.Users++
+		if created {
+			result.UsersCreated++
+		}
+	}
+
+	for _, ch := range append(channels, groups...) {
+		roomID, created, err := s.importSlackChannel(ch, uid, users)
+		if err != nil {
+			return result, err
+		}
+		result.Rooms++
+		if created {
+			result.RoomsCreated++
+		}
+
+		found, inserted, err := s.importSlackMessages(files, ch, roomID, users)
+		if err != nil {
+			return result, err
+		}
+		result.Chats += found
+		result.ChatsCreated += inserted
+	}
+
+	return result, nil
+}
+
+func (s *Service) importSlackUser(su slackUser) (UserChat, bool, error) {
+	ref := "slack:user:" + su.ID
+	if id, ok, err := s.findImportRef(ref); err != nil || ok {
+		if err != nil {
+			return UserChat{}, false, err
+		}
+		u, err := s.findUserChatById(id)
+		return u, false, err
+	}
+
+	email := normalizeEmail(su.Profile.Email)
+	if email != "" {
+		if u, err := s.findUserByEmail(email); err == nil {
+			return s.linkImportRef(ref, UserChat{ID: u.ID, Username: u.Username, Name: u.Name, Lastname: u.Lastname}, false)
+		} else if err != mongo.ErrNoDocuments {
+			return UserChat{}, false, err
+		}
+	}
+
+	name, lastname := su.Profile.FirstName, su.Profile.LastName
+	if name == "" {
+		name = firstNonEmpty(su.Profile.DisplayName, su.Profile.RealName, su.RealName, su.Name)
+	}
+	now := time.Now()
+	user := User{
+		ID:            primitive.NewObjectID(),
+		Name:          name,
+		Lastname:      lastname,
+		Placeholder:   true,
+		ImportedEmail: email,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Collection("users").InsertOne(ctx, user); err != nil {
+		return UserChat{}, false, err
+	}
+
+	return s.linkImportRef(ref, UserChat{ID: user.ID, Name: user.Name, Lastname: user.Lastname}, true)
+}
+
+// ClaimPlaceholder gives the messages of an imported placeholder to a
+// registered user, for admins only. The user joins the public rooms the
+// placeholder was in; private rooms need an invite like anyone else.
+func (s *Service) ClaimPlaceholder(ctx context.Context, placeholderID, userID primitive.ObjectID) error {
+	if _, err := s.AuthUserID(ctx); err != nil {
+		return err
+	}
+	if !s.isAdmin(ctx) {
+		return ErrNotAdmin
+	}
+
+	users := s.db.Collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var placeholder, user User
+	if err := users.FindOne(ctx, bson.M{"_id": placeholderID}).Decode(&placeholder); err == mongo.ErrNoDocuments {
+		return ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+	if !placeholder.Placeholder {
+		return ErrNotPlaceholder
+	}
+	if err := users.FindOne(ctx, bson.M{"_id": userID, "placeholder": bson.M{"$ne": true}}).Decode(&user); err == mongo.ErrNoDocuments {
+		return ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+
+	rooms, err := s.RoomIDsForUser(placeholderID)
+	if err != nil {
+		return err
+	}
+	for _, roomID := range rooms {
+		room, err := s.findRoom(roomID)
+		if err != nil {
+			return err
+		}
+		if room.Private {
+			continue
+		}
+		if err := s.addRoomMember(roomID, userID, RoleMember); err != nil && err != ErrAlreadyRoomMember {
+			return err
+		}
+	}
+
+	if _, err := s.db.Collection("chats").UpdateMany(ctx, bson.M{"sender": placeholderID}, bson.M{"$set": bson.M{"sender": userID}}); err != nil {
+		return err
+	}
+	// later imports of the same export map to the user too
+	if _, err := s.db.Collection("import_refs").UpdateMany(ctx, bson.M{"target": placeholderID}, bson.M{"$set": bson.M{"target": userID}}); err != nil {
+		return err
+	}
+	if _, err := s.db.Collection("room_members").DeleteMany(ctx, bson.M{"user": placeholderID}); err != nil {
+		return err
+	}
+	// the placeholder stays, so mentions of it still show its name
+	_, err = users.UpdateOne(ctx, bson.M{"_id": placeholderID}, bson.M{"$set": bson.M{"claimed_by": userID, "updated_at": time.Now()}})
+
+	return err
+}
+
+// linkImportRef records the user an import ref became. If another import got
+// there first, its user wins.
+func (s *Service) linkImportRef(ref string, u UserChat, created bool) (UserChat, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.db.Collection("import_refs").InsertOne(ctx, importRef{Ref: ref, Target: u.ID})
+	if isDuplicateKeyError(err) {
+		id, _, err := s.findImportRef(ref)
+		if err != nil {
+			return u, false, err
+		}
+		u, err = s.findUserChatById(id)
+		return u, false, err
+	}
+
+	return u, created, err
+}
+
+func (s *Service) importSlackChannel(ch slackChannel, owner primitive.ObjectID, users map[string]UserChat) (primitive.ObjectID, bool, error) {
+	ref := "slack:channel:" + ch.ID
+	roomID, found, err := s.findImportRef(ref)
+	if err != nil {
+		return roomID, false, err
+	}
+
+	if !found {
+		roomID = primitive.NewObjectID()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := s.db.Collection("import_refs").InsertOne(ctx, importRef{Ref: ref, Target: roomID})
+		cancel()
+		if isDuplicateKeyError(err) {
+			if roomID, _, err = s.findImportRef(ref); err != nil {
+				return roomID, false, err
+			}
+		} else if err != nil {
+			return roomID, false, err
+		}
+	}
+
+	topic := firstNonEmpty(ch.Topic.Value, ch.Purpose.Value)
+	if len([]rune(topic)) > maxTopicLength {
+		topic = string([]rune(topic)[:maxTopicLength])
+	}
+	room := Room{
+		ID:                roomID,
+		Name:              ch.Name,
+		Topic:             topic,
+		Private:           ch.private,
+		Owner:             owner,
+		HistoryVisibility: HistoryAll,
+		PinPermission:     PinByMembers,
+		CreatedAt:         time.Unix(ch.Created, 0),
+		UpdatedAt:         time.Now(),
+	}
+	// upserted, so a run that died between the ref and the room still creates it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	res, err := s.db.Collection("rooms").UpdateOne(ctx, bson.M{"_id": roomID}, bson.M{"$setOnInsert": room}, options.Update().SetUpsert(true))
+	cancel()
+	if err != nil {
+		return roomID, false, err
+	}
+	created := res.UpsertedCount > 0
+
+	// members are added on every run, so a failed run catches up
+	if err := s.addRoomMember(roomID, owner, RoleOwner); err != nil && err != ErrAlreadyRoomMember {
+		return roomID, created, err
+	}
+	for _, member := range ch.Members {
+		u, ok := users[member]
+		if !ok || u.ID == owner {
+			continue
+		}
+		if err := s.addRoomMember(roomID, u.ID, RoleMember); err != nil && err != ErrAlreadyRoomMember {
+			return roomID, created, err
+		}
+	}
+
+	return roomID, created, nil
+}
+
+// importSlackMessages imports the daily message files of a channel, oldest
+// first. Chat IDs are derived from the Slack timestamps, so messages already
+// imported are skipped.
+func (s *Service) importSlackMessages(files map[string]*zip.File, ch slackChannel, roomID primitive.ObjectID, users map[string]UserChat) (int, int, error) {
+	latest, err := s.latestChatTime(roomID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var days []string
+	for name := range files {
+		if path.Dir(name) == ch.Name && strings.HasSuffix(name, ".json") {
+			days = append(days, name)
+		}
+	}
+	sort.Strings(days)
+
+	found, inserted := 0, 0
+	known := make(map[primitive.ObjectID]bool)
+	var batch []interface{}
+	flush := func() error {
+		n, err := s.insertImported(batch, latest)
+		inserted += n
+		batch = batch[:0]
+		return err
+	}
+
+	for _, day := range days {
+		var messages []slackMessage
+		if err := readZipJSON(files, day, &messages); err != nil {
+			return found, inserted, err
+		}
+		sort.SliceStable(messages, func(i, j int) bool { return messages[i].TS < messages[j].TS })
+
+		for _, m := range messages {
+			u, ok := users[m.User]
+			if m.Type != "message" || !ok || (m.Subtype != "" && m.Subtype != "thread_broadcast" && m.Subtype != "file_share") {
+				continue
+			}
+			sent, err := slackTime(m.TS)
+			if err != nil {
+				continue
+			}
+
+			chat := Chat{
+				ID:        slackChatID(ch.ID, m.TS, sent),
+				Room:      roomID,
+				Sender:    u.ID,
+				Message:   slackText(m.Text, users),
+				Type:      KindText,
+				CreatedAt: sent,
+			}
+			for _, f := range m.Files {
+				chat.Message += "\n[" + f.Name + "](" + f.Permalink + ")"
+			}
+			chat.Message = strings.TrimSpace(chat.Message)
+			if chat.Message == "" {
+				continue
+			}
+			if m.ThreadTS != "" && m.ThreadTS != m.TS {
+				if parentSent, err := slackTime(m.ThreadTS); err == nil {
+					parentID := slackChatID(ch.ID, m.ThreadTS, parentSent)
+					// replies to skipped messages become plain messages
+					if ok, err := s.importedParent(parentID, known); err != nil {
+						return found, inserted, err
+					} else if ok {
+						chat.ParentID = &parentID
+					}
+				}
+			}
+
+			found++
+			known[chat.ID] = true
+			batch = append(batch, chat)
+			if len(batch) == importBatchSize {
+				if err := flush(); err != nil {
+					return found, inserted, err
+				}
+			}
+		}
+	}
+
+	return found, inserted, flush()
+}
+
+// importedParent reports whether the parent of a reply was imported, now or
+// by an earlier run.
+func (s *Service) importedParent(parentID primitive.ObjectID, known map[primitive.ObjectID]bool) (bool, error) {
+	if known[parentID] {
+		return true, nil
+	}
+
+	_, err := s.findChat(parentID)
+	if err == ErrChatNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// latestChatTime returns when the last chat of the room was sent, zero when
+// it has none.
+func (s *Service) latestChatTime(roomID primitive.ObjectID) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.FindOne().SetSort(bson.M{"seq": -1}).SetProjection(bson.M{"created_at": 1})
+	var chat Chat
+	err := s.db.Collection("chats").FindOne(ctx, bson.M{"room": roomID}, opts).Decode(&chat)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+
+	return chat.CreatedAt, err
+}
+
+// insertImported inserts the chats that don't exist yet, numbering them in
+// order, and returns how many it inserted. Chats sent before latest, the
+// last chat the room had before the import, would get a higher number than
+// newer ones, so they fail the import instead.
+func (s *Service) insertImported(batch []interface{}, latest time.Time) (int, error) {
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	ids := make(bson.A, len(batch))
+	for i, c := range batch {
+		ids[i] = c.(Chat).ID
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	existing := make(map[primitive.ObjectID]bool)
+	cur, err := s.db.Collection("chats").Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	for cur.Next(ctx) {
+		var c struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cur.Decode(&c); err != nil {
+			return 0, err
+		}
+		existing[c.ID] = true
+	}
+	if err := cur.Err(); err != nil {
+		return 0, err
+	}
+
+	var docs []interface{}
+	for _, c := range batch {
+		chat := c.(Chat)
+		if existing[chat.ID] {
+			continue
+		}
+		if chat.CreatedAt.Before(latest) {
+			return 0, ErrImportOutOfOrder
+		}
+		if chat.Seq, err = s.nextSeq(chat.Room); err != nil {
+			return 0, err
+		}
+		docs = append(docs, chat)
+	}
+	if len(docs) == 0 {
+		return 0, nil
+	}
+
+	_, err = s.db.Collection("chats").InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if bwe, ok := err.(mongo.BulkWriteException); ok && isDuplicateKeyError(err) {
+		// a concurrent import inserted some of them
+		return len(docs) - len(bwe.WriteErrors), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(docs), nil
+}
+
+func (s *Service) findImportRef(ref string) (primitive.ObjectID, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var r importRef
+	err := s.db.Collection("import_refs").FindOne(ctx, bson.M{"_id": ref}).Decode(&r)
+	if err == mongo.ErrNoDocuments {
+		return r.Target, false, nil
+	}
+	if err != nil {
+		return r.Target, false, err
+	}
+
+	return r.Target, true, nil
+}
+
+func readZipJSON(files map[string]*zip.File, name string, v interface{}) error {
+	f, ok := files[name]
+	if !ok {
+		return ErrInvalidImport
+	}
+	if f.UncompressedSize64 > maxImportFileSize {
+		return ErrImportTooLarge
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// the size in the header is only what the archive claims
+	if err := json.NewDecoder(io.LimitReader(rc, maxImportFileSize)).Decode(v); err != nil {
+		return ErrInvalidImport
+	}
+
+	return nil
+}
+
+// slackTime parses a Slack timestamp such as "1585000000.000200".
+func slackTime(ts string) (time.Time, error) {
+	parts := strings.SplitN(ts, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var usec int64
+	if len(parts) == 2 {
+		if usec, err = strconv.ParseInt((parts[1] + "000000")[:6], 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return time.Unix(sec, usec*1000), nil
+}
+
+// slackChatID builds the chat ID of a Slack message: the send time, so
+// ID based date filters keep working, followed by a hash of the message so
+// importing it again gives the same ID.
+func slackChatID(channel, ts string, sent time.Time) primitive.ObjectID {
+	var id primitive.ObjectID
+	binary.BigEndian.PutUint32(id[0:4], uint32(sent.Unix()))
+	sum := sha1.Sum([]byte(channel + ":" + ts))
+	copy(id[4:], sum[:8])
+
+	return id
+}
+
+// slackText turns the Slack markup of a message into the Markdown of ours.
+func slackText(text string, users map[string]UserChat) string {
+	text = slackUserTag.ReplaceAllStringFunc(text, func(m string) string {
+		u, ok := users[slackUserTag.FindStringSubmatch(m)[1]]
+		if !ok {
+			return "@unknown"
+		}
+		if u.Username != "" {
+			return "@" + u.Username
+		}
+		return "@" + strings.TrimSpace(u.Name+" "+u.Lastname)
+	})
+	text = slackChannelTag.ReplaceAllString(text, "#$1")
+	text = slackSpecialTag.ReplaceAllString(text, "@$1")
+	text = slackLinkTag.ReplaceAllStringFunc(text, func(m string) string {
+		parts := slackLinkTag.FindStringSubmatch(m)
+		if parts[2] == "" {
+			return parts[1]
+		}
+		return "[" + parts[2] + "](" + parts[1] + ")"
+	})
+
+	return html.UnescapeString(text)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+
+	return ""
+}
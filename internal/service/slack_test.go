@@ -0,0 +1,94 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSlackTime(t *testing.T) {
+	tests := []struct {
+		ts      string
+		want    time.Time
+		wantErr bool
+	}{
+		{ts: "1585000000.000200", want: time.Unix(1585000000, 200000)},
+		{ts: "1585000000.5", want: time.Unix(1585000000, 500000000)},
+		{ts: "1585000000.1234567", want: time.Unix(1585000000, 123456000)},
+		{ts: "1585000000", want: time.Unix(1585000000, 0)},
+		{ts: "", wantErr: true},
+		{ts: "abc.000100", wantErr: true},
+		{ts: "1585000000.x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ts, func(t *testing.T) {
+			got, err := slackTime(tt.ts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("slackTime(%q) error = %v, wantErr %v", tt.ts, err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("slackTime(%q) = %v, want %v", tt.ts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlackChatID(t *testing.T) {
+	sent := time.Unix(1585000000, 200000)
+	id := slackChatID("C01", "1585000000.000200", sent)
+
+	tests := []struct {
+		name string
+		got  primitive.ObjectID
+		same bool
+	}{
+		{"same message", slackChatID("C01", "1585000000.000200", sent), true},
+		{"other channel", slackChatID("C02", "1585000000.000200", sent), false},
+		{"other message", slackChatID("C01", "1585000000.000300", sent), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if (tt.got == id) != tt.same {
+				t.Errorf("slackChatID() = %s, first was %s, want same %v", tt.got.Hex(), id.Hex(), tt.same)
+			}
+		})
+	}
+
+	if got := id.Timestamp(); !got.Equal(time.Unix(1585000000, 0)) {
+		t.Errorf("Timestamp() = %v, want the send time", got)
+	}
+}
+
+func TestSlackText(t *testing.T) {
+	users := map[string]UserChat{
+		"U1": {Username: "ana"},
+		"U2": {Name: "Bob", Lastname: "Reis"},
+	}
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain", "hello", "hello"},
+		{"user with username", "hi <@U1>", "hi @ana"},
+		{"user with label", "hi <@U1|ana.l>", "hi @ana"},
+		{"user without username", "hi <@U2>", "hi @Bob Reis"},
+		{"unknown user", "hi <@U9>", "hi @unknown"},
+		{"channel", "see <#C01|general>", "see #general"},
+		{"special", "<!here> and <!channel|channel>", "@here and @channel"},
+		{"bare link", "<https://example.com/a?b=1>", "https://example.com/a?b=1"},
+		{"labelled link", "<https://example.com|the site>", "[the site](https://example.com)"},
+		{"mailto", "<mailto:a@b.com|mail me>", "[mail me](mailto:a@b.com)"},
+		{"entities", "a &lt; b &amp;&amp; c &gt; d", "a < b && c > d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := slackText(tt.text, users); got != tt.want {
+				t.Errorf("slackText(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
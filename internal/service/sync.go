@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxSyncGap is how many missed chats a sync returns before telling the
+// client to reload the room instead.
+const maxSyncGap = 200
+
+// SyncCursor is the last chat a client has of a room, by sequence number or,
+// for chats from before sequence numbers, by ID. An empty cursor falls back
+// to the last delivery the user acknowledged.
+type SyncCursor struct {
+	Room primitive.ObjectID
+	Seq  int64
+	ID   primitive.ObjectID
+}
+
+// DeliveryState is the last chat of a room a user acknowledged receiving.
+type DeliveryState struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Room      primitive.ObjectID `bson:"room" json:"room"`
+	User      primitive.ObjectID `bson:"user" json:"user"`
+	Seq       int64              `bson:"seq" json:"seq"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+type syncOutput struct {
+	Room primitive.ObjectID `json:"room"`
+	// Chats are the missed chats, oldest first. Updated are the chats the
+	// client already had that were edited, deleted, reacted to or voted on
+	// since. When Reload is set there were too many and the client should
+	// load the room again instead.
+	Chats   []chatOutput `json:"chats"`
+	Updated []chatOutput `json:"updated"`
+	Reload  bool         `json:"reload"`
+	// Seq is the latest sequence number of the room.
+	Seq int64 `json:"seq"`
+}
+
+// Sync returns what the authenticated user missed in each room since the
+// cursor. Without cursors it syncs the lobby and every room of the user from
+// their acknowledged deliveries.
+func (s *Service) Sync(ctx context.Context, cursors []SyncCursor) ([]syncOutput, error) {
+	outs := []syncOutput{}
+
+	uid, _ := s.AuthUserID(ctx)
+	if len(cursors) == 0 && !uid.IsZero() {
+		ids, err := s.RoomIDsForUser(uid)
+		if err != nil {
+			return outs, err
+		}
+		cursors = append(cursors, SyncCursor{})
+		for _, id := range ids {
+			cursors = append(cursors, SyncCursor{Room: id})
+		}
+	}
+
+	for _, cursor := range cursors {
+		out, err := s.syncRoom(uid, cursor)
+		if err != nil {
+			return outs, err
+		}
+		outs = append(outs, out)
+	}
+
+	return outs, nil
+}
+
+func (s *Service) syncRoom(uid primitive.ObjectID, cursor SyncCursor) (syncOutput, error) {
+	out := syncOutput{Room: cursor.Room, Chats: []chatOutput{}, Updated: []chatOutput{}}
+
+	filter := bson.M{
+		"room":       bson.M{"$exists": false},
+		"parent_id":  bson.M{"$exists": false},
+		"expires_at": notExpired(),
+	}
+	if !cursor.Room.IsZero() {
+		_, since, err := s.roomAccess(cursor.Room, uid)
+		if err != nil {
+			return out, err
+		}
+		filter["room"] = cursor.Room
+		if !since.IsZero() {
+			filter["created_at"] = bson.M{"$gte": since}
+		}
+	}
+
+	var err error
+	if out.Seq, err = s.currentSeq(cursor.Room); err != nil {
+		return out, err
+	}
+
+	// newer matches the chats past the cursor, last is when the chat at the
+	// cursor was sent, which the client can't have seen changes before
+	var newer bson.M
+	var last time.Time
+	switch {
+	case cursor.Seq > 0:
+		newer = bson.M{"seq": bson.M{"$gt": cursor.Seq}}
+		if last, err = s.seqTime(filter, cursor.Seq); err != nil {
+			return out, err
+		}
+	case !cursor.ID.IsZero():
+		chat, err := s.findChat(cursor.ID)
+		if err == ErrChatNotFound || (err == nil && chat.Room != cursor.Room) {
+			out.Reload = true
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+		if chat.Seq > 0 {
+			newer = bson.M{"seq": bson.M{"$gt": chat.Seq}}
+		} else {
+			newer = bson.M{"_id": bson.M{"$gt": chat.ID}}
+		}
+		last = chat.CreatedAt
+	default:
+		delivered, err := s.deliveredSeq(cursor.Room, uid)
+		if err != nil {
+			return out, err
+		}
+		if delivered == 0 {
+			out.Reload = true
+			return out, nil
+		}
+		newer = bson.M{"seq": bson.M{"$gt": delivered}}
+		if last, err = s.seqTime(filter, delivered); err != nil {
+			return out, err
+		}
+	}
+
+	missed := bson.M{"$and": bson.A{filter, newer}}
+	chats, reload, err := s.syncChats(missed)
+	if err != nil || reload {
+		out.Reload = reload
+		return out, err
+	}
+	if out.Chats, err = s.chatOutputs(uid, chats); err != nil {
+		return out, err
+	}
+
+	updated := bson.M{"$and": bson.A{filter, bson.M{"$nor": bson.A{newer}}, bson.M{"updated_at": bson.M{"$gte": last}}}}
+	chats, reload, err = s.syncChats(updated)
+	if err != nil || reload {
+		out.Chats, out.Reload = []chatOutput{}, reload
+		return out, err
+	}
+	if out.Updated, err = s.chatOutputs(uid, chats); err != nil {
+		return out, err
+	}
+
+	return out, nil
+}
+
+// syncChats finds the chats of a sync, reporting when there are too many.
+func (s *Service) syncChats(filter bson.M) ([]Chat, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(historyOrder()).SetLimit(maxSyncGap + 1)
+	cur, err := s.db.Collection("chats").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	var chats []Chat
+	if err := cur.All(ctx, &chats); err != nil {
+		return nil, false, err
+	}
+
+	return chats, len(chats) > maxSyncGap, nil
+}
+
+// seqTime returns when the chat at seq, or the closest one before it that
+// is still around, was sent. It is zero when there is none.
+func (s *Service) seqTime(filter bson.M, seq int64) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.FindOne().SetSort(bson.M{"seq": -1}).SetProjection(bson.M{"created_at": 1})
+	var chat Chat
+	err := s.db.Collection("chats").FindOne(ctx, bson.M{"$and": bson.A{filter, bson.M{"seq": bson.M{"$lte": seq}}}}, opts).Decode(&chat)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+
+	return chat.CreatedAt, err
+}
+
+// touchChat records that something shown with the chat changed, such as its
+// reactions, so syncs pick it up. Failures are only logged.
+func (s *Service) touchChat(chatID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Collection("chats").UpdateOne(ctx, bson.M{"_id": chatID}, bson.M{"$max": bson.M{"updated_at": time.Now()}}); err != nil {
+		log.Printf("could not touch chat %s: %v", chatID.Hex(), err)
+	}
+}
+
+// AckDelivery records that the authenticated user received the chats of the
+// room up to seq. It never goes backwards, so acks may arrive out of order.
+func (s *Service) AckDelivery(ctx context.Context, roomID primitive.ObjectID, seq int64) error {
+	uid, err := s.AuthUserID(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.checkRoomAccess(roomID, uid); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{"room": roomID, "user": uid}
+	update := bson.M{
+		"$max":         bson.M{"seq": seq},
+		"$set":         bson.M{"updated_at": time.Now()},
+		"$setOnInsert": bson.M{"_id": primitive.NewObjectID()},
+	}
+	_, err = s.db.Collection("delivery_states").UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if isDuplicateKeyError(err) {
+		// a concurrent ack created it first, apply ours on top
+		_, err = s.db.Collection("delivery_states").UpdateOne(ctx, filter, update)
+	}
+
+	return err
+}
+
+func (s *Service) deliveredSeq(roomID, userID primitive.ObjectID) (int64, error) {
+	if userID.IsZero() {
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var state DeliveryState
+	err := s.db.Collection("delivery_states").FindOne(ctx, bson.M{"room": roomID, "user": userID}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+
+	return state.Seq, err
+}
+
+func (s *Service) currentSeq(roomID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var counter roomCounter
+	err := s.db.Collection("room_counters").FindOne(ctx, bson.M{"_id": roomID}).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+
+	return counter.Seq, err
+}
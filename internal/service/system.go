@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Room events reported by system messages.
+const (
+	EventMemberJoined = "member_joined"
+	EventMemberLeft   = "member_left"
+	EventMemberAdded  = "member_added"
+	EventRoomRenamed  = "room_renamed"
+	EventTopicChanged = "topic_changed"
+)
+
+// SystemEvent describes what happened in a system message. The sender of the
+// message is the user who caused it.
+type SystemEvent struct {
+	Event string `bson:"event" json:"event"`
+	// User is who the event is about, when it isn't the sender.
+	User *primitive.ObjectID `bson:"user,omitempty" json:"user,omitempty"`
+	From string              `bson:"from,omitempty" json:"from,omitempty"`
+	To   string              `bson:"to,omitempty" json:"to,omitempty"`
+}
+
+// postSystemMessage records a room event in its history and sends it to the
+// room like any other message. Failures are only logged, the event itself
+// already happened.
+func (s *Service) postSystemMessage(roomID, actor primitive.ObjectID, event SystemEvent) {
+	now := time.Now()
+	chat := Chat{
+		ID:        primitive.NewObjectID(),
+		Room:      roomID,
+		Sender:    actor,
+		Type:      KindSystem,
+		Payload:   &Payload{System: &event},
+		CreatedAt: now,
+	}
+	if err := s.setExpiry(&chat); err != nil {
+		log.Printf("could not load room %s: %v", roomID.Hex(), err)
+		return
+	}
+	seq, err := s.nextSeq(roomID)
+	if err != nil {
+		log.Printf("could not number %s event of room %s: %v", event.Event, roomID.Hex(), err)
+		return
+	}
+	chat.Seq = seq
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Collection("chats").InsertOne(ctx, chat); err != nil {
+		log.Printf("could not save %s event of room %s: %v", event.Event, roomID.Hex(), err)
+		return
+	}
+
+	out, err := s.chatOutput(chat)
+	if err != nil {
+		log.Printf("could not load %s event of room %s: %v", event.Event, roomID.Hex(), err)
+		return
+	}
+
+	s.events.Broadcast(roomID, "output_message", out)
+}
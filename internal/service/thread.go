@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrInvalidParent used when a reply points to a chat that can't have replies.
+var ErrInvalidParent = errors.New("invalid parent message")
+
+type lastReply struct {
+	ID        primitive.ObjectID `bson:"id" json:"id"`
+	Sender    UserChat           `bson:"-" json:"sender"`
+	SenderID  primitive.ObjectID `bson:"sender" json:"-"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// ThreadSummary describes the replies of a parent chat.
+type ThreadSummary struct {
+	Parent     primitive.ObjectID `bson:"_id" json:"parent_id"`
+	Room       primitive.ObjectID `bson:"-" json:"room,omitempty"`
+	ReplyCount int                `bson:"reply_count" json:"reply_count"`
+	LastReply  lastReply          `bson:"last_reply" json:"last_reply"`
+}
+
+// validateParent checks that the reply can be attached to its parent: the
+// parent must exist in the same room, not be deleted, and not be a reply
+// itself.
+func (s *Service) validateParent(c Chat) error {
+	if c.ParentID == nil {
+		return nil
+	}
+
+	parent, err := s.findChat(*c.ParentID)
+	if err == ErrChatNotFound {
+		return ErrInvalidParent
+	}
+	if err != nil {
+		return err
+	}
+
+	if parent.Room != c.Room || parent.DeletedAt != nil || parent.ParentID != nil {
+		return ErrInvalidParent
+	}
+
+	return nil
+}
+
+// GetThread retrieves the replies of a chat, oldest first.
+func (s *Service) GetThread(ctx context.Context, parentID primitive.ObjectID) ([]chatOutput, error) {
+	uid, _ := s.AuthUserID(ctx)
+
+	parent, err := s.findChat(parentID)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"parent_id": parent.ID, "expires_at": notExpired()}
+	if !parent.Room.IsZero() {
+		_, since, err := s.roomAccess(parent.Room, uid)
+		if err != nil {
+			return nil, err
+		}
+		if !since.IsZero() {
+			filter["created_at"] = bson.M{"$gte": since}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(historyOrder())
+	cur, err := s.db.Collection("chats").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var replies []Chat
+	if err := cur.All(ctx, &replies); err != nil {
+		return nil, err
+	}
+
+	return s.chatOutputs(uid, replies)
+}
+
+// GetThreadSummary retrieves the reply count and last reply of a chat.
+func (s *Service) GetThreadSummary(parentID primitive.ObjectID) (ThreadSummary, error) {
+	summaries, err := s.threadSummaries([]primitive.ObjectID{parentID})
+	if err != nil {
+		return ThreadSummary{}, err
+	}
+
+	summary, ok := summaries[parentID]
+	if !ok {
+		summary = ThreadSummary{Parent: parentID}
+	}
+
+	parent, err := s.findChat(parentID)
+	if err != nil {
+		return summary, err
+	}
+	summary.Room = parent.Room
+
+	return summary, nil
+}
+
+func (s *Service) threadSummaries(parentIDs []primitive.ObjectID) (map[primitive.ObjectID]ThreadSummary, error) {
+	out := make(map[primitive.ObjectID]ThreadSummary)
+	if len(parentIDs) == 0 {
+		return out, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{
+			"parent_id":  bson.M{"$in": parentIDs},
+			"deleted_at": bson.M{"$exists": false},
+		}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+		bson.M{"$group": bson.M{
+			"_id":         "$parent_id",
+			"reply_count": bson.M{"$sum": 1},
+			"last_reply": bson.M{"$last": bson.M{
+				"id":         "$_id",
+				"sender":     "$sender",
+				"created_at": "$created_at",
+			}},
+		}},
+	}
+	cur, err := s.db.Collection("chats").Aggregate(ctx, pipeline)
+	if err != nil {
+		return out, err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var summary ThreadSummary
+		if err := cur.Decode(&summary); err != nil {
+			return out, err
+		}
+
+		if summary.LastReply.Sender, err = s.findUserChatById(summary.LastReply.SenderID); err != nil {
+			return out, err
+		}
+		out[summary.Parent] = summary
+	}
+
+	return out, cur.Err()
+}
+
+// CheckThreadAccess checks whether the authenticated user can follow the
+// thread of a chat, returning the room of the thread.
+func (s *Service) CheckThreadAccess(ctx context.Context, parentID primitive.ObjectID) (primitive.ObjectID, error) {
+	uid, _ := s.AuthUserID(ctx)
+
+	parent, err := s.findChat(parentID)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if parent.ParentID != nil {
+		return primitive.NilObjectID, ErrInvalidParent
+	}
+
+	return parent.Room, s.checkRoomAccess(parent.Room, uid)
+}
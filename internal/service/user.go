@@ -3,10 +3,13 @@ package service
 import (
 	"context"
 	"errors"
+	"regexp"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -27,8 +30,11 @@ var (
 	ErrUnsupportedAvatarFormat = errors.New("only png and jpeg allowed as avatar")
 )
 
+var usernamePattern = regexp.MustCompile(`^[a-z0-9_.]{3,32}$`)
+
 type User struct {
 	ID        primitive.ObjectID `bson:"_id" json:"id,omitempty"`
+	Username  string             `bson:"username,omitempty" json:"username,omitempty"`
 	Name      string             `bson:"name" json:"name"`
 	Email     string             `bson:"email" json:"email"`
 	Password  string             `bson:"password" json:"-"`
@@ -36,12 +42,19 @@ type User struct {
 	AvatarURL *string            `bson:"avatar_url" json:"avatar_url"`
 	Token     string             `bson:"token" json:"token"`
 	TokenExp  time.Time          `bson:"token_exp" json:"expires_at"`
-	CreatedAt time.Time          `bson:"created_at" json:"created_at,omitempty"`
-	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at,omitempty"`
+	// Placeholder users were imported from elsewhere and can't log in. They
+	// keep the imported email aside, an admin links them to the user who
+	// registers with it, see ClaimPlaceholder.
+	Placeholder   bool                `bson:"placeholder,omitempty" json:"placeholder,omitempty"`
+	ImportedEmail string              `bson:"imported_email,omitempty" json:"imported_email,omitempty"`
+	ClaimedBy     *primitive.ObjectID `bson:"claimed_by,omitempty" json:"claimed_by,omitempty"`
+	CreatedAt     time.Time           `bson:"created_at" json:"created_at,omitempty"`
+	UpdatedAt     time.Time           `bson:"updated_at" json:"updated_at,omitempty"`
 }
 
 type UserChat struct {
 	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Username  string             `bson:"username,omitempty" json:"username,omitempty"`
 	Name      string             `bson:"name" json:"name"`
 	Email     string             `bson:"email" json:"email"`
 	Lastname  string             `bson:"lastname" json:"lastname"`
@@ -53,7 +66,13 @@ type userCreatedOutput struct {
 	Email string `json:"email"`
 }
 
-func (s *Service) Register(name, email, lastname, password string) error {
+func (s *Service) Register(name, email, lastname, username, password string) error {
+
+	email = normalizeEmail(email)
+	username = strings.ToLower(username)
+	if username != "" && !usernamePattern.MatchString(username) {
+		return ErrInvalidUsername
+	}
 
 	hashPassword, err := hash(password)
 	if err != nil {
@@ -61,6 +80,7 @@ func (s *Service) Register(name, email, lastname, password string) error {
 	}
 	user := &User{
 		ID:        primitive.NewObjectID(),
+		Username:  username,
 		Name:      name,
 		Email:     email,
 		Lastname:  lastname,
@@ -73,11 +93,23 @@ func (s *Service) Register(name, email, lastname, password string) error {
 	collection := s.db.Collection("users")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	collection.InsertOne(ctx, user)
+
+	_, err = collection.InsertOne(ctx, user)
+	if isDuplicateKeyError(err) {
+		return ErrUsernameTaken
+	}
+	if err != nil {
+		return err
+	}
 	// send mail routine
 	return nil
 }
 
+// normalizeEmail makes the emails typed differently the same.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 func hash(password string) ([]byte, error) {
 	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 }
@@ -87,7 +119,7 @@ func (s *Service) findUserByEmail(email string) (User, error) {
 	collection := s.db.Collection("users")
 	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
 	u := User{}
-	err := collection.FindOne(ctx, bson.M{"email": email}).Decode(&u)
+	err := collection.FindOne(ctx, bson.M{"email": email, "placeholder": bson.M{"$ne": true}}).Decode(&u)
 	if err != nil {
 
 		return u, err
@@ -96,6 +128,26 @@ func (s *Service) findUserByEmail(email string) (User, error) {
 	return u, nil
 }
 
+// GetUserByUsername finds a user by username, with or without the leading @.
+func (s *Service) GetUserByUsername(username string) (UserChat, error) {
+	u, err := s.findUserByUsername(strings.ToLower(strings.TrimPrefix(username, "@")))
+	if err == mongo.ErrNoDocuments {
+		return u, ErrUserNotFound
+	}
+
+	return u, err
+}
+
+func (s *Service) findUserByUsername(username string) (UserChat, error) {
+	collection := s.db.Collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u := UserChat{}
+	err := collection.FindOne(ctx, bson.M{"username": username}).Decode(&u)
+
+	return u, err
+}
+
 func (s *Service) findUserChatById(id primitive.ObjectID) (UserChat, error) {
 	collection := s.db.Collection("users")
 	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
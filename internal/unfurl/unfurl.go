@@ -0,0 +1,250 @@
+// Package unfurl fetches the OpenGraph and Twitter card metadata of links so
+// messages can show a preview of them.
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const maxRedirects = 3
+
+var (
+	// ErrBlockedAddress used when the link resolves to a private address.
+	ErrBlockedAddress = errors.New("address not allowed")
+	// ErrUnsupportedURL used when the link is not an http(s) URL.
+	ErrUnsupportedURL = errors.New("unsupported url")
+	// ErrNotHTML used when the link doesn't point to an HTML page.
+	ErrNotHTML = errors.New("not an html page")
+)
+
+// Preview is the metadata of a link.
+type Preview struct {
+	URL         string `bson:"url" json:"url"`
+	Title       string `bson:"title,omitempty" json:"title,omitempty"`
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+	Image       string `bson:"image,omitempty" json:"image,omitempty"`
+	SiteName    string `bson:"site_name,omitempty" json:"site_name,omitempty"`
+}
+
+// Empty reports whether the page had nothing worth previewing.
+func (p Preview) Empty() bool {
+	return p.Title == "" && p.Description == "" && p.Image == ""
+}
+
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+// New returns a Fetcher that gives up after timeout, reads at most maxBytes
+// of each page and refuses to connect to private, loopback and other
+// non-public addresses, including through redirects.
+func New(timeout time.Duration, maxBytes int64) *Fetcher {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		// checked on the resolved address, so DNS can't point us inside
+		Control: blockPrivate,
+	}
+	transport := &http.Transport{
+		Proxy:                  nil,
+		DialContext:            dialer.DialContext,
+		TLSHandshakeTimeout:    timeout,
+		ResponseHeaderTimeout:  timeout,
+		MaxResponseHeaderBytes: 64 << 10,
+		DisableKeepAlives:      true,
+	}
+
+	return NewWithClient(&http.Client{Timeout: timeout, Transport: transport}, maxBytes)
+}
+
+// NewWithClient returns a Fetcher using the given client as is, without the
+// private address protection. Meant for tests against httptest servers.
+func NewWithClient(client *http.Client, maxBytes int64) *Fetcher {
+	c := *client
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return ErrUnsupportedURL
+		}
+		return nil
+	}
+
+	return &Fetcher{client: &c, maxBytes: maxBytes}
+}
+
+// Fetch downloads the page and extracts its preview.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (Preview, error) {
+	preview := Preview{URL: rawURL}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return preview, ErrUnsupportedURL
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return preview, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "suchat-unfurl/1.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return preview, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return preview, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return preview, ErrNotHTML
+	}
+
+	meta := parseMeta(io.LimitReader(resp.Body, f.maxBytes))
+
+	preview.Title = first(meta["og:title"], meta["twitter:title"], meta["title"])
+	preview.Description = first(meta["og:description"], meta["twitter:description"], meta["description"])
+	preview.SiteName = first(meta["og:site_name"], resp.Request.URL.Hostname())
+	if image := first(meta["og:image"], meta["og:image:url"], meta["twitter:image"]); image != "" {
+		preview.Image = absoluteURL(resp.Request.URL, image)
+	}
+
+	return preview, nil
+}
+
+// parseMeta collects the meta tags and the title of the page head.
+func parseMeta(r io.Reader) map[string]string {
+	meta := make(map[string]string)
+	z := html.NewTokenizer(r)
+	inTitle := false
+
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return meta
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "body":
+				return meta
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, content string
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					switch string(k) {
+					case "property", "name":
+						key = strings.ToLower(string(v))
+					case "content":
+						content = strings.TrimSpace(string(v))
+					}
+				}
+				if key != "" && content != "" {
+					if _, ok := meta[key]; !ok {
+						meta[key] = content
+					}
+				}
+			}
+
+		case html.TextToken:
+			if inTitle {
+				if _, ok := meta["title"]; !ok {
+					meta["title"] = strings.TrimSpace(string(z.Text()))
+				}
+			}
+
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "title" {
+				inTitle = false
+			}
+		}
+	}
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// absoluteURL resolves ref against base, dropping anything but http(s).
+func absoluteURL(base *url.URL, ref string) string {
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+
+	return u.String()
+}
+
+var blockedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func blockPrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ErrBlockedAddress
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return ErrBlockedAddress
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(t *testing.T, contentType, body string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestFetch(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want Preview
+	}{
+		{
+			name: "opengraph",
+			body: `<html><head>
+				<meta property="og:title" content="Release day">
+				<meta property="og:description" content=" All about it ">
+				<meta property="og:site_name" content="Suchat">
+				<meta property="og:image" content="/cover.png">
+				<title>Ignored</title>
+				</head><body></body></html>`,
+			want: Preview{Title: "Release day", Description: "All about it", SiteName: "Suchat", Image: "/cover.png"},
+		},
+		{
+			name: "twitter and title fallbacks",
+			body: `<html><head>
+				<title>Page title</title>
+				<meta name="twitter:description" content="Card text">
+				<meta name="twitter:image" content="https://cdn.example.com/a.png">
+				</head></html>`,
+			want: Preview{Title: "Page title", Description: "Card text", SiteName: "127.0.0.1", Image: "https://cdn.example.com/a.png"},
+		},
+		{
+			name: "stops at body",
+			body: `<html><head><title>Head</title></head>
+				<body><meta property="og:description" content="in body"></body></html>`,
+			want: Preview{Title: "Head", SiteName: "127.0.0.1"},
+		},
+		{
+			name: "drops non web images",
+			body: `<meta property="og:title" content="T"><meta property="og:image" content="javascript:alert(1)">`,
+			want: Preview{Title: "T", SiteName: "127.0.0.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := serve(t, "text/html; charset=utf-8", tt.body)
+			want := tt.want
+			want.URL = srv.URL + "/page"
+			if strings.HasPrefix(want.Image, "/") {
+				want.Image = srv.URL + want.Image
+			}
+
+			got, err := NewWithClient(srv.Client(), 1<<20).Fetch(context.Background(), want.URL)
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			if got != want {
+				t.Errorf("Fetch() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		url         string
+		want        error
+	}{
+		{name: "not html", contentType: "image/png", want: ErrNotHTML},
+		{name: "ftp", contentType: "text/html", url: "ftp://example.com/", want: ErrUnsupportedURL},
+		{name: "no host", contentType: "text/html", url: "http:///path", want: ErrUnsupportedURL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := serve(t, tt.contentType, "<title>x</title>")
+			url := tt.url
+			if url == "" {
+				url = srv.URL
+			}
+
+			_, err := NewWithClient(srv.Client(), 1<<20).Fetch(context.Background(), url)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Fetch() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchSizeLimit(t *testing.T) {
+	padding := "<!--" + strings.Repeat("x", 4096) + "-->"
+	body := `<html><head><meta property="og:title" content="Early">` +
+		padding + `<meta property="og:description" content="Late"></head></html>`
+	srv := serve(t, "text/html", body)
+
+	got, err := NewWithClient(srv.Client(), 1024).Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if got.Title != "Early" {
+		t.Errorf("Title = %q, want %q", got.Title, "Early")
+	}
+	if got.Description != "" {
+		t.Errorf("Description = %q, want it past the limit", got.Description)
+	}
+}
+
+func TestFetchRedirects(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL+r.URL.Path+"x", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	if _, err := NewWithClient(srv.Client(), 1<<20).Fetch(context.Background(), srv.URL+"/"); err == nil {
+		t.Error("Fetch() followed redirects forever")
+	}
+}
+
+func TestFetchBlocksPrivateAddresses(t *testing.T) {
+	srv := serve(t, "text/html", "<title>internal</title>")
+
+	// httptest listens on loopback, which New must refuse to dial
+	_, err := New(time.Second, 1<<20).Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Fetch() error = %v, want %v", err, ErrBlockedAddress)
+	}
+}
+
+func TestBlockPrivate(t *testing.T) {
+	tests := []struct {
+		address string
+		blocked bool
+	}{
+		{"127.0.0.1:80", true},
+		{"10.1.2.3:443", true},
+		{"172.16.0.1:80", true},
+		{"192.168.1.1:80", true},
+		{"169.254.169.254:80", true},
+		{"100.64.0.1:80", true},
+		{"0.0.0.0:80", true},
+		{"[::1]:80", true},
+		{"[fd00::1]:80", true},
+		{"[fe80::1]:80", true},
+		{"[::ffff:127.0.0.1]:80", true},
+		{"93.184.216.34:80", false},
+		{"8.8.8.8:443", false},
+		{"[2606:4700::1111]:443", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := blockPrivate("tcp", tt.address, nil)
+			if blocked := errors.Is(err, ErrBlockedAddress); blocked != tt.blocked {
+				t.Errorf("blockPrivate(%q) = %v, want blocked %v", tt.address, err, tt.blocked)
+			}
+		})
+	}
+}
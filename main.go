@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/leogsouza/api-suchat/internal/handler"
 	"github.com/leogsouza/api-suchat/internal/helper"
 	"github.com/leogsouza/api-suchat/internal/service"
+	"github.com/leogsouza/api-suchat/internal/unfurl"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -44,7 +47,30 @@ func main() {
 	}
 
 	db := client.Database("suchat")
-	s := service.New(db)
+	s := service.New(db, service.Config{
+		EditWindow:     helper.EnvDuration("CHAT_EDIT_WINDOW", 15*time.Minute),
+		MaxPinsPerRoom: helper.EnvInt("ROOM_MAX_PINS", 50),
+		Unfurler: unfurl.New(
+			helper.EnvDuration("UNFURL_TIMEOUT", 5*time.Second),
+			int64(helper.EnvInt("UNFURL_MAX_BYTES", 512<<10)),
+		),
+		PreviewCacheTTL:      helper.EnvDuration("UNFURL_CACHE_TTL", 24*time.Hour),
+		PurgeBatchSize:       helper.EnvInt("PURGE_BATCH_SIZE", 500),
+		PublicURL:            helper.Env("PUBLIC_URL", "http://localhost:"+port),
+		Admins:               strings.Split(helper.Env("ADMIN_EMAILS", ""), ","),
+		LobbyRetentionDays:   helper.EnvInt("LOBBY_RETENTION_DAYS", 0),
+		LobbyRetentionAction: helper.Env("LOBBY_RETENTION_ACTION", service.RetentionDelete),
+	})
+
+	if err = s.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+
+	go s.RunScheduler(context.Background(), helper.EnvDuration("SCHEDULER_INTERVAL", 5*time.Second))
+	go s.RunExpirer(context.Background(), helper.EnvDuration("EXPIRER_INTERVAL", 5*time.Second))
+	go s.RunExporter(context.Background(), helper.EnvDuration("EXPORTER_INTERVAL", 5*time.Second))
+	go s.RunReminders(context.Background(), helper.EnvDuration("REMINDER_INTERVAL", 30*time.Second))
+	go s.RunPurger(context.Background(), helper.EnvDuration("PURGE_INTERVAL", time.Hour), helper.EnvBool("PURGE_DRY_RUN", false))
 
 	h := handler.New(s)
 